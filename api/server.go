@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -38,6 +39,9 @@ type ApiServer struct {
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	quit                chan struct{}
+	srvMu               sync.Mutex
+	srv                 *http.Server
 }
 
 type Entry struct {
@@ -54,6 +58,7 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		quit:                make(chan struct{}),
 	}
 }
 
@@ -84,6 +89,10 @@ func (s *ApiServer) Start() {
 	go func() {
 		for {
 			select {
+			case <-s.quit:
+				statsTimer.Stop()
+				purgeTimer.Stop()
+				return
 			case <-statsTimer.C:
 				if !s.config.PurgeOnly {
 					s.collectStats()
@@ -107,14 +116,37 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/miners", s.MinersIndex)
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
+	r.HandleFunc("/api/upstreams", s.UpstreamsIndex)
 	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
 	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
+
+	s.srvMu.Lock()
+	select {
+	case <-s.quit:
+		s.srvMu.Unlock()
+		return
+	default:
+	}
+	s.srv = &http.Server{Addr: s.config.Listen, Handler: r}
+	s.srvMu.Unlock()
+
+	err := s.srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start API: %v", err)
 	}
 }
 
+func (s *ApiServer) Stop(ctx context.Context) error {
+	log.Println("Stopping API")
+	s.srvMu.Lock()
+	defer s.srvMu.Unlock()
+	close(s.quit)
+	if s.srv != nil {
+		return s.srv.Shutdown(ctx)
+	}
+	return nil
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -180,6 +212,34 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *ApiServer) UpstreamsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	reply := make(map[string]interface{})
+	upstreams, err := s.backend.GetUpstreamStates()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get upstreams from backend: %v", err)
+		return
+	}
+	events, err := s.backend.GetUpstreamEvents()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get upstream events from backend: %v", err)
+		return
+	}
+	reply["upstreams"] = upstreams
+	reply["events"] = events
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
 func (s *ApiServer) MinersIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -3,13 +3,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/yvasiyarov/gorelic"
 
@@ -17,6 +21,7 @@ import (
 	"github.com/virbicoin/open-virbicoin-pool/payouts"
 	"github.com/virbicoin/open-virbicoin-pool/proxy"
 	"github.com/virbicoin/open-virbicoin-pool/storage"
+	"github.com/virbicoin/open-virbicoin-pool/util"
 )
 
 // Version information (set by build flags)
@@ -38,24 +43,69 @@ func printVersion() {
 var cfg proxy.Config
 var backend *storage.RedisClient
 
+// Used when shutdownTimeout is not configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// Modules are stopped in reverse order of start
+var stoppers []func(ctx context.Context) error
+
 func startProxy() {
 	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	stoppers = append(stoppers, s.Stop)
+	go s.Start()
 }
 
 func startApi() {
 	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
+	stoppers = append(stoppers, s.Stop)
+	go s.Start()
 }
 
 func startBlockUnlocker() {
 	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-	u.Start()
+	stoppers = append(stoppers, func(context.Context) error {
+		u.Stop()
+		return nil
+	})
+	go u.Start()
 }
 
 func startPayoutsProcessor() {
 	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
+	stoppers = append(stoppers, func(context.Context) error {
+		u.Stop()
+		return nil
+	})
+	go u.Start()
+}
+
+// Returns process exit status
+func shutdown(timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan int, 1)
+	go func() {
+		status := 0
+		for i := len(stoppers) - 1; i >= 0; i-- {
+			if err := stoppers[i](ctx); err != nil {
+				log.Printf("Shutdown error: %v", err)
+				status = 1
+			}
+		}
+		if err := backend.Close(); err != nil {
+			log.Printf("Failed to close backend connection: %v", err)
+		}
+		done <- status
+	}()
+
+	select {
+	case status := <-done:
+		return status
+	case <-ctx.Done():
+		log.Printf("Shutdown did not finish in %v, exiting anyway", timeout)
+		return 1
+	}
 }
 
 func startNewrelic() {
@@ -120,18 +170,38 @@ func main() {
 		log.Printf("Backend check reply: %v", pong)
 	}
 
+	shutdownTimeout := defaultShutdownTimeout
+	if len(cfg.ShutdownTimeout) > 0 {
+		shutdownTimeout = util.MustParseDuration(cfg.ShutdownTimeout)
+	}
+
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		startProxy()
 	}
 	if cfg.Api.Enabled {
-		go startApi()
+		startApi()
 	}
 	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
+		startBlockUnlocker()
 	}
 	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+		startPayoutsProcessor()
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("Received %v, shutting down, send it again to exit immediately", sig)
+
+	go func() {
+		<-sigs
+		log.Println("Forced exit")
+		os.Exit(1)
+	}()
+
+	status := shutdown(shutdownTimeout)
+	if status == 0 {
+		log.Println("Shutdown complete")
 	}
-	quit := make(chan bool)
-	<-quit
+	os.Exit(status)
 }
@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -48,10 +49,13 @@ type PayoutsProcessor struct {
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	// Held while processing payouts, Stop waits for bookkeeping of a payment in progress
+	runMu sync.Mutex
+	quit  chan struct{}
 }
 
 func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
+	u := &PayoutsProcessor{config: cfg, backend: backend, quit: make(chan struct{})}
 	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
 	return u
 }
@@ -91,14 +95,42 @@ func (u *PayoutsProcessor) Start() {
 	u.process()
 
 	go func() {
-		for range timer.C {
-			u.process()
-			timer.Reset(intv)
+		for {
+			select {
+			case <-u.quit:
+				timer.Stop()
+				return
+			case <-timer.C:
+				u.process()
+				timer.Reset(intv)
+			}
 		}
 	}()
 }
 
+func (u *PayoutsProcessor) Stop() {
+	log.Println("Stopping payouts")
+	close(u.quit)
+	u.runMu.Lock()
+	u.runMu.Unlock()
+}
+
+func (u *PayoutsProcessor) stopping() bool {
+	select {
+	case <-u.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (u *PayoutsProcessor) process() {
+	u.runMu.Lock()
+	defer u.runMu.Unlock()
+
+	if u.stopping() {
+		return
+	}
 	if u.halt {
 		log.Println("Payments suspended due to last critical error:", u.lastFail)
 		return
@@ -113,6 +145,11 @@ func (u *PayoutsProcessor) process() {
 	}
 
 	for _, login := range payees {
+		// Never start a new payment while shutting down
+		if u.stopping() {
+			log.Println("Payouts interrupted by shutdown")
+			break
+		}
 		amount, err := u.backend.GetBalance(login)
 		if err != nil {
 			log.Printf("Error while retrieving balance for %s: %v", login, err)
@@ -194,10 +231,14 @@ func (u *PayoutsProcessor) process() {
 		totalAmount.Add(totalAmount, big.NewInt(amount))
 		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
 
-		// Wait for TX confirmation before further payouts
-		for {
+		// Wait for TX confirmation before further payouts, payment is already logged so shutdown may skip it
+		for !u.stopping() {
 			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
+			select {
+			case <-u.quit:
+				continue
+			case <-time.After(txCheckInterval):
+			}
 			receipt, err := u.rpc.GetTxReceipt(txHash)
 			if err != nil {
 				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
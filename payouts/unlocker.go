@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/math"
@@ -18,6 +19,7 @@ import (
 type UnlockerConfig struct {
 	Enabled        bool    `json:"enabled"`
 	PoolFee        float64 `json:"poolFee"`
+	SoloFee        float64 `json:"soloFee"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
 	Donate         bool    `json:"donate"`
 	Depth          int64   `json:"depth"`
@@ -46,6 +48,9 @@ type BlockUnlocker struct {
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	// Held for the whole unlocking pass, so Stop never interrupts crediting
+	runMu sync.Mutex
+	quit  chan struct{}
 }
 
 func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
@@ -58,7 +63,7 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
 	if cfg.ImmatureDepth < minDepth {
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
+	u := &BlockUnlocker{config: cfg, backend: backend, quit: make(chan struct{})}
 	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
 	return u
 }
@@ -70,17 +75,41 @@ func (u *BlockUnlocker) Start() {
 	log.Printf("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
+	u.run()
 
 	go func() {
-		for range ticker.C {
-			u.unlockPendingBlocks()
-			u.unlockAndCreditMiners()
+		for {
+			select {
+			case <-u.quit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				u.run()
+			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) run() {
+	u.runMu.Lock()
+	defer u.runMu.Unlock()
+	select {
+	case <-u.quit:
+		return
+	default:
+	}
+	u.unlockPendingBlocks()
+	u.unlockAndCreditMiners()
+}
+
+// Waits for unlocking pass in progress to complete
+func (u *BlockUnlocker) Stop() {
+	log.Println("Stopping block unlocker")
+	close(u.quit)
+	u.runMu.Lock()
+	u.runMu.Unlock()
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -443,7 +472,11 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
+	fee := u.config.PoolFee
+	if block.Solo {
+		fee = u.config.SoloFee
+	}
+	minersProfit, poolProfit := chargeFee(revenue, fee)
 
 	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
 	if err != nil {
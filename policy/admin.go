@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/virbicoin/open-virbicoin-pool/util"
+)
+
+var ErrInvalidEntry = errors.New("invalid list entry")
+
+// Ban in force with stats of banned address, times are in milliseconds
+type BanInfo struct {
+	IP            string `json:"ip"`
+	BannedAt      int64  `json:"bannedAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+	Instance      string `json:"instance,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	ValidShares   int32  `json:"validShares"`
+	InvalidShares int32  `json:"invalidShares"`
+	Malformed     int32  `json:"malformed"`
+	ConnLimit     int32  `json:"connLimit"`
+	// Recent offences of all instances, ban escalates with their number
+	Offences []Offence `json:"offences,omitempty"`
+}
+
+/* Lists bans of this instance along with shared ones not applied here yet.
+ * Local bans are listed even if backend fails, error is returned as well.
+ */
+func (s *PolicyServer) Bans() ([]BanInfo, error) {
+	shared, err := s.storage.GetBans()
+	reasons := make(map[string]BanInfo)
+	for _, ban := range shared {
+		reasons[ban.IP] = BanInfo{
+			IP:        ban.IP,
+			BannedAt:  ban.BannedAt * 1000,
+			ExpiresAt: ban.ExpiresAt * 1000,
+			Instance:  ban.Instance,
+			Reason:    ban.Reason,
+		}
+	}
+
+	result := make([]BanInfo, 0, len(reasons))
+	s.statsMu.Lock()
+	for ip, x := range s.stats {
+		if atomic.LoadInt32(&x.Banned) == 0 {
+			continue
+		}
+		info := BanInfo{
+			IP:        ip,
+			BannedAt:  atomic.LoadInt64(&x.BannedAt),
+			ExpiresAt: atomic.LoadInt64(&x.BanExpiresAt),
+			Malformed: atomic.LoadInt32(&x.Malformed),
+			ConnLimit: atomic.LoadInt32(&x.ConnLimit),
+		}
+		x.Lock()
+		info.ValidShares, info.InvalidShares = x.ValidShares, x.InvalidShares
+		x.Unlock()
+		if ban, ok := reasons[ip]; ok {
+			info.Instance, info.Reason = ban.Instance, ban.Reason
+			delete(reasons, ip)
+		}
+		result = append(result, info)
+	}
+	s.statsMu.Unlock()
+
+	for _, info := range reasons {
+		result = append(result, info)
+	}
+	now := util.MakeTimestamp()
+	for i := range result {
+		result[i].Offences = s.offences(result[i].IP, now)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].BannedAt > result[j].BannedAt })
+	return result, err
+}
+
+// Offences within history window by address, banned now or not
+func (s *PolicyServer) Offences() map[string][]Offence {
+	return s.history.all(util.MakeTimestamp())
+}
+
+// Lifts ban here and on other instances, next ban of the address does not escalate
+func (s *PolicyServer) LiftBan(ip string) error {
+	s.liftLocalBan(ip, util.MakeTimestamp())
+	s.history.clear(ip)
+	log.Printf("Ban lifted for %v", ip)
+	return s.storage.RemoveBan(ip)
+}
+
+// Ban placed after lift stays in force
+func (s *PolicyServer) liftLocalBan(ip string, liftedAt int64) bool {
+	s.statsMu.Lock()
+	x, ok := s.stats[ip]
+	lifted := ok && atomic.LoadInt64(&x.BannedAt) <= liftedAt && atomic.CompareAndSwapInt32(&x.Banned, 1, 0)
+	if lifted {
+		atomic.StoreInt64(&x.BannedAt, 0)
+		atomic.StoreInt64(&x.BanExpiresAt, 0)
+		delete(s.stats, ip)
+	}
+	s.statsMu.Unlock()
+
+	if lifted {
+		s.history.clear(ip)
+	}
+	if lifted && s.backend != nil {
+		s.banChannel <- banOp{ip: ip, unban: true}
+	}
+	return lifted
+}
+
+// Blacklist takes miner addresses and IP entries, lists are reloaded right away
+func (s *PolicyServer) UpdateBlacklist(entry string, add bool) error {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if _, ok := parseIPEntry(entry); !ok && !util.IsValidHexAddress(entry) {
+		return ErrInvalidEntry
+	}
+	return s.updateList("blacklist", entry, add)
+}
+
+// Whitelist takes IP entries only
+func (s *PolicyServer) UpdateWhitelist(entry string, add bool) error {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if _, ok := parseIPEntry(entry); !ok {
+		return ErrInvalidEntry
+	}
+	return s.updateList("whitelist", entry, add)
+}
+
+func (s *PolicyServer) updateList(list, entry string, add bool) error {
+	if err := s.storage.UpdatePolicyList(list, entry, add); err != nil {
+		return err
+	}
+	if add {
+		log.Printf("Added %v to %v", entry, list)
+	} else {
+		log.Printf("Removed %v from %v", entry, list)
+	}
+	s.refreshLists()
+	return nil
+}
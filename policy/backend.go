@@ -0,0 +1,333 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firewall or other place bans are enforced at
+type BanBackend interface {
+	Ban(ip string, timeout time.Duration) error
+	Unban(ip string) error
+	List() ([]string, error)
+}
+
+/* Backend comes from banning.backend, configs predating it ban on ipset with
+ * sudo if ipset is set and in process otherwise.
+ */
+func newBanBackend(cfg *Banning) (BanBackend, error) {
+	backend, sudo := cfg.Backend, cfg.Sudo
+	if len(backend) == 0 {
+		if len(cfg.IPSet) > 0 {
+			backend, sudo = "ipset", true
+		} else {
+			backend = "memory"
+			log.Printf("No ban backend or ipset configured, falling back to memory backend")
+		}
+	}
+	switch backend {
+	case "ipset":
+		if len(cfg.IPSet) == 0 {
+			return nil, fmt.Errorf("ipset backend requires ipset name")
+		}
+		return &ipsetBackend{set: cfg.IPSet, sudo: sudo}, nil
+	case "nftables":
+		table := strings.Fields(cfg.NFTable)
+		if len(table) != 2 || len(cfg.NFSet) == 0 {
+			return nil, fmt.Errorf("nftables backend requires nftTable as \"<family> <table>\" and nftSet")
+		}
+		return &nftablesBackend{family: table[0], table: table[1], set: cfg.NFSet, sudo: sudo}, nil
+	case "iptables":
+		if len(cfg.IPTablesChain) == 0 {
+			return nil, fmt.Errorf("iptables backend requires iptablesChain")
+		}
+		return &iptablesBackend{chain: cfg.IPTablesChain, sudo: sudo}, nil
+	case "memory":
+		return newMemoryBackend(), nil
+	case "script":
+		if len(cfg.Script) == 0 {
+			return nil, fmt.Errorf("script backend requires script path")
+		}
+		return &scriptBackend{path: cfg.Script, sudo: sudo}, nil
+	}
+	return nil, fmt.Errorf("unknown ban backend %q", backend)
+}
+
+// Arguments go to the binary as is, no shell is involved
+func runCommand(sudo bool, name string, args ...string) ([]byte, error) {
+	if sudo {
+		args = append([]string{name}, args...)
+		name = "sudo"
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+func timeoutSeconds(timeout time.Duration) string {
+	return strconv.FormatInt(int64(timeout/time.Second), 10)
+}
+
+type ipsetBackend struct {
+	set  string
+	sudo bool
+}
+
+func (b *ipsetBackend) Ban(ip string, timeout time.Duration) error {
+	_, err := runCommand(b.sudo, "ipset", "add", b.set, ip, "timeout", timeoutSeconds(timeout), "-exist")
+	return err
+}
+
+func (b *ipsetBackend) Unban(ip string) error {
+	_, err := runCommand(b.sudo, "ipset", "del", b.set, ip, "-exist")
+	return err
+}
+
+func (b *ipsetBackend) List() ([]string, error) {
+	out, err := runCommand(b.sudo, "ipset", "list", b.set)
+	if err != nil {
+		return nil, err
+	}
+	return parseIPSetList(out), nil
+}
+
+// Members follow "Members:" line, one per line with optional timeout
+func parseIPSetList(out []byte) []string {
+	var result []string
+	members := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "Members:" {
+			members = true
+			continue
+		}
+		if fields := strings.Fields(line); members && len(fields) > 0 {
+			result = append(result, fields[0])
+		}
+	}
+	return result
+}
+
+type nftablesBackend struct {
+	family string
+	table  string
+	set    string
+	sudo   bool
+}
+
+// Set must be created with timeout flag to accept element timeouts
+func (b *nftablesBackend) Ban(ip string, timeout time.Duration) error {
+	_, err := runCommand(b.sudo, "nft", "add", "element", b.family, b.table, b.set, "{", ip, "timeout", timeoutSeconds(timeout)+"s", "}")
+	return err
+}
+
+func (b *nftablesBackend) Unban(ip string) error {
+	_, err := runCommand(b.sudo, "nft", "delete", "element", b.family, b.table, b.set, "{", ip, "}")
+	return err
+}
+
+func (b *nftablesBackend) List() ([]string, error) {
+	out, err := runCommand(b.sudo, "nft", "list", "set", b.family, b.table, b.set)
+	if err != nil {
+		return nil, err
+	}
+	return parseNFTList(out), nil
+}
+
+// Elements are listed as "elements = { 10.0.0.1 timeout 30m expires 29m, ... }"
+func parseNFTList(out []byte) []string {
+	s := string(out)
+	start := strings.Index(s, "elements = {")
+	if start < 0 {
+		return nil
+	}
+	s = s[start+len("elements = {"):]
+	if end := strings.Index(s, "}"); end >= 0 {
+		s = s[:end]
+	}
+	var result []string
+	for _, element := range strings.Split(s, ",") {
+		if fields := strings.Fields(element); len(fields) > 0 {
+			result = append(result, fields[0])
+		}
+	}
+	return result
+}
+
+/* Plain DROP rule per address, iptables has no timeouts, so rule stays until
+ * policy server lifts the ban. IPv6 addresses go to ip6tables.
+ */
+type iptablesBackend struct {
+	chain string
+	sudo  bool
+}
+
+func iptablesFor(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (b *iptablesBackend) Ban(ip string, timeout time.Duration) error {
+	bin := iptablesFor(ip)
+	// Check first, so repeated ban does not stack rules
+	if _, err := runCommand(b.sudo, bin, "-C", b.chain, "-s", ip, "-j", "DROP"); err == nil {
+		return nil
+	}
+	_, err := runCommand(b.sudo, bin, "-I", b.chain, "-s", ip, "-j", "DROP")
+	return err
+}
+
+func (b *iptablesBackend) Unban(ip string) error {
+	_, err := runCommand(b.sudo, iptablesFor(ip), "-D", b.chain, "-s", ip, "-j", "DROP")
+	return err
+}
+
+// Hosts without IPv6 may lack ip6tables chain or binary, nothing is banned there then
+func (b *iptablesBackend) List() ([]string, error) {
+	out, err := runCommand(b.sudo, "iptables", "-S", b.chain)
+	if err != nil {
+		return nil, err
+	}
+	result := parseIPTablesList(out)
+	out, err = runCommand(b.sudo, "ip6tables", "-S", b.chain)
+	if err != nil {
+		if missingChain(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	return append(result, parseIPTablesList(out)...), nil
+}
+
+func missingChain(err error) bool {
+	msg := err.Error()
+	return errors.Is(err, exec.ErrNotFound) || strings.Contains(msg, "No chain/target/match") || strings.Contains(msg, "command not found")
+}
+
+// Rules are listed as "-A <chain> -s 10.0.0.1/32 -j DROP"
+func parseIPTablesList(out []byte) []string {
+	var result []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[0] != "-A" || fields[len(fields)-1] != "DROP" {
+			continue
+		}
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] == "-s" {
+				ip := fields[i+1]
+				ip = strings.TrimSuffix(ip, "/32")
+				ip = strings.TrimSuffix(ip, "/128")
+				result = append(result, ip)
+				break
+			}
+		}
+	}
+	return result
+}
+
+/* Bans kept in process only, banned miners are dropped by stratum and HTTP
+ * handlers. Needs no privileges, so it also suits containers and tests.
+ */
+type memoryBackend struct {
+	sync.Mutex
+	bans map[string]time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{bans: make(map[string]time.Time)}
+}
+
+func (b *memoryBackend) Ban(ip string, timeout time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+	b.bans[ip] = time.Now().Add(timeout)
+	return nil
+}
+
+func (b *memoryBackend) Unban(ip string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.bans, ip)
+	return nil
+}
+
+func (b *memoryBackend) List() ([]string, error) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	result := make([]string, 0, len(b.bans))
+	for ip, expiresAt := range b.bans {
+		if now.After(expiresAt) {
+			delete(b.bans, ip)
+			continue
+		}
+		result = append(result, ip)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Script is called as "<script> ban <ip> <timeout seconds>", "<script> unban <ip>" and "<script> list"
+type scriptBackend struct {
+	path string
+	sudo bool
+}
+
+func (b *scriptBackend) Ban(ip string, timeout time.Duration) error {
+	_, err := runCommand(b.sudo, b.path, "ban", ip, timeoutSeconds(timeout))
+	return err
+}
+
+func (b *scriptBackend) Unban(ip string) error {
+	_, err := runCommand(b.sudo, b.path, "unban", ip)
+	return err
+}
+
+// Script prints one banned address per line
+func (b *scriptBackend) List() ([]string, error) {
+	out, err := runCommand(b.sudo, b.path, "list")
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			result = append(result, line)
+		}
+	}
+	return result, nil
+}
+
+func logBackend(b BanBackend) {
+	switch v := b.(type) {
+	case *ipsetBackend:
+		log.Printf("Banning on ipset %s", v.set)
+	case *nftablesBackend:
+		log.Printf("Banning on nftables set %s %s %s", v.family, v.table, v.set)
+	case *iptablesBackend:
+		log.Printf("Banning on iptables chain %s", v.chain)
+	case *scriptBackend:
+		log.Printf("Banning with script %s", v.path)
+	default:
+		log.Printf("Banning in process only with memory backend")
+	}
+}
@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewBanBackend(t *testing.T) {
+	b, err := newBanBackend(&Banning{IPSet: "blacklist"})
+	if v, ok := b.(*ipsetBackend); err != nil || !ok || !v.sudo {
+		t.Errorf("Config with ipset only must ban on ipset with sudo, got %#v %v", b, err)
+	}
+	if b, _ := newBanBackend(&Banning{}); b == nil {
+		t.Error("Expected in process backend by default")
+	} else if _, ok := b.(*memoryBackend); !ok {
+		t.Errorf("Expected in process backend by default, got %#v", b)
+	}
+	b, err = newBanBackend(&Banning{Backend: "nftables", NFTable: "inet filter", NFSet: "banned"})
+	if v, ok := b.(*nftablesBackend); err != nil || !ok || v.family != "inet" || v.table != "filter" || v.sudo {
+		t.Errorf("Wrong nftables backend %#v %v", b, err)
+	}
+	if _, err := newBanBackend(&Banning{Backend: "nftables", NFSet: "banned"}); err == nil {
+		t.Error("nftables backend without table must fail")
+	}
+	if _, err := newBanBackend(&Banning{Backend: "pf"}); err == nil {
+		t.Error("Unknown backend must fail")
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := newMemoryBackend()
+	b.Ban("10.0.0.2", time.Minute)
+	b.Ban("10.0.0.1", time.Minute)
+	b.Ban("10.0.0.3", -time.Second)
+	b.Unban("10.0.0.2")
+	if list, _ := b.List(); !reflect.DeepEqual(list, []string{"10.0.0.1"}) {
+		t.Errorf("Expected only 10.0.0.1 to be banned, got %v", list)
+	}
+}
+
+func TestParseBanLists(t *testing.T) {
+	ipset := `Name: blacklist
+Type: hash:ip
+Header: family inet hashsize 1024 maxelem 65536 timeout 1800
+Size in memory: 248
+References: 1
+Number of entries: 2
+Members:
+10.0.0.1 timeout 1799
+10.0.0.2 timeout 12
+`
+	if list := parseIPSetList([]byte(ipset)); !reflect.DeepEqual(list, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Wrong ipset members %v", list)
+	}
+
+	nft := `table inet filter {
+	set banned {
+		type ipv4_addr
+		flags timeout
+		elements = { 10.0.0.1 timeout 30m expires 29m58s,
+			     10.0.0.2 timeout 30m expires 10m }
+	}
+}
+`
+	if list := parseNFTList([]byte(nft)); !reflect.DeepEqual(list, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Wrong nftables elements %v", list)
+	}
+	if list := parseNFTList([]byte("table inet filter {\n\tset banned {\n\t}\n}\n")); len(list) != 0 {
+		t.Errorf("Empty set must have no elements, got %v", list)
+	}
+
+	iptables := `-N pool-bans
+-A pool-bans -s 10.0.0.1/32 -j DROP
+-A pool-bans -s 10.0.0.0/24 -p tcp -j ACCEPT
+-A pool-bans -s 10.0.0.2/32 -j DROP
+`
+	if list := parseIPTablesList([]byte(iptables)); !reflect.DeepEqual(list, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Wrong iptables rules %v", list)
+	}
+}
+
+func TestIPTablesMissingV6Chain(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"iptables":  "#!/bin/sh\necho '-N banned'\necho '-A banned -s 10.0.0.1/32 -j DROP'\n",
+		"ip6tables": "#!/bin/sh\necho 'ip6tables: No chain/target/match by that name.' >&2\nexit 1\n",
+	}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+
+	b := &iptablesBackend{chain: "banned"}
+	list, err := b.List()
+	if err != nil || !reflect.DeepEqual(list, []string{"10.0.0.1"}) {
+		t.Errorf("Missing ip6tables chain must be listed as empty, got %v %v", list, err)
+	}
+}
@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Most recent offences kept per address
+const maxOffences = 16
+
+const defaultHistoryWindow = 24 * time.Hour
+
+// Timeout is in seconds, time of offence in milliseconds
+type Offence struct {
+	At       int64  `json:"at"`
+	Reason   string `json:"reason"`
+	Timeout  int64  `json:"timeout"`
+	Instance string `json:"instance,omitempty"`
+}
+
+/* Offences of an address outlive its stats, so a miner coming back after ban
+ * is banned for longer. Offences older than window are forgotten. Backend
+ * keeps offences of all instances, history of an address is replaced with
+ * them before each ban.
+ */
+type offenceHistory struct {
+	sync.Mutex
+	window   int64
+	offences map[string][]Offence
+}
+
+func newOffenceHistory(window time.Duration) *offenceHistory {
+	return &offenceHistory{window: int64(window / time.Millisecond), offences: make(map[string][]Offence)}
+}
+
+func (h *offenceHistory) recent(ip string, now int64) []Offence {
+	list := h.offences[ip]
+	i := 0
+	for i < len(list) && now-list[i].At >= h.window {
+		i++
+	}
+	return list[i:]
+}
+
+func (h *offenceHistory) add(ip string, offence Offence) {
+	h.Lock()
+	defer h.Unlock()
+	list := append(h.recent(ip, offence.At), offence)
+	if len(list) > maxOffences {
+		list = list[len(list)-maxOffences:]
+	}
+	h.offences[ip] = list
+}
+
+func (h *offenceHistory) set(ip string, list []Offence) {
+	h.Lock()
+	defer h.Unlock()
+	if len(list) > maxOffences {
+		list = list[len(list)-maxOffences:]
+	}
+	if len(list) == 0 {
+		delete(h.offences, ip)
+	} else {
+		h.offences[ip] = list
+	}
+}
+
+func (h *offenceHistory) clear(ip string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.offences, ip)
+}
+
+func (h *offenceHistory) get(ip string, now int64) []Offence {
+	h.Lock()
+	defer h.Unlock()
+	return append([]Offence(nil), h.recent(ip, now)...)
+}
+
+func (h *offenceHistory) all(now int64) map[string][]Offence {
+	h.Lock()
+	defer h.Unlock()
+	result := make(map[string][]Offence)
+	for ip := range h.offences {
+		if list := h.recent(ip, now); len(list) > 0 {
+			result[ip] = append([]Offence(nil), list...)
+		}
+	}
+	return result
+}
+
+// Returns number of addresses forgotten
+func (h *offenceHistory) prune(now int64) int {
+	h.Lock()
+	defer h.Unlock()
+	total := 0
+	for ip := range h.offences {
+		if len(h.recent(ip, now)) == 0 {
+			delete(h.offences, ip)
+			total++
+		}
+	}
+	return total
+}
+
+/* Ban lasts timeout multiplied by multiplier once per recent offence, up to
+ * maxTimeout. Multiplier of 1 or less keeps every ban at timeout.
+ */
+func banTimeout(cfg *Banning, offences int) int64 {
+	timeout := float64(cfg.Timeout)
+	if cfg.Multiplier > 1 {
+		timeout *= math.Pow(cfg.Multiplier, float64(offences))
+	}
+	if cfg.MaxTimeout > 0 && timeout > float64(cfg.MaxTimeout) {
+		return cfg.MaxTimeout
+	}
+	return int64(math.Min(timeout, math.MaxInt32))
+}
@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanTimeout(t *testing.T) {
+	cfg := &Banning{Timeout: 600, Multiplier: 2, MaxTimeout: 3600}
+	for offences, expected := range []int64{600, 1200, 2400, 3600, 3600} {
+		if timeout := banTimeout(cfg, offences); timeout != expected {
+			t.Errorf("Expected %v for %v offences, got %v", expected, offences, timeout)
+		}
+	}
+	if timeout := banTimeout(&Banning{Timeout: 600}, 5); timeout != 600 {
+		t.Errorf("Ban must not escalate without multiplier, got %v", timeout)
+	}
+}
+
+func TestOffenceHistory(t *testing.T) {
+	h := newOffenceHistory(time.Hour)
+	now := int64(10 * 3600 * 1000)
+	hour := int64(3600 * 1000)
+
+	h.add("10.0.0.1", Offence{At: now - 2*hour, Reason: "invalid shares"})
+	h.add("10.0.0.1", Offence{At: now - hour/2, Reason: "malformed requests"})
+	h.add("10.0.0.2", Offence{At: now - 2*hour, Reason: "socket flood"})
+
+	if list := h.get("10.0.0.1", now); len(list) != 1 || list[0].Reason != "malformed requests" {
+		t.Errorf("Only offences within window must count, got %v", list)
+	}
+	if n := h.prune(now); n != 1 {
+		t.Errorf("Expected 1 address to be forgotten, got %v", n)
+	}
+	if all := h.all(now); len(all) != 1 {
+		t.Errorf("Expected 1 address in history, got %v", all)
+	}
+
+	for i := 0; i < maxOffences+5; i++ {
+		h.add("10.0.0.3", Offence{At: now})
+	}
+	if n := len(h.get("10.0.0.3", now)); n != maxOffences {
+		t.Errorf("History must be capped at %v, got %v", maxOffences, n)
+	}
+}
+
+func TestOffenceHistorySetAndClear(t *testing.T) {
+	h := newOffenceHistory(time.Hour)
+	now := int64(10 * 3600 * 1000)
+
+	h.add("10.0.0.1", Offence{At: now, Reason: "invalid shares"})
+	h.set("10.0.0.1", []Offence{{At: now - 2, Instance: "eu"}, {At: now - 1, Instance: "main"}})
+	if list := h.get("10.0.0.1", now); len(list) != 2 || list[0].Instance != "eu" {
+		t.Errorf("History must be replaced with backend offences, got %v", list)
+	}
+	h.clear("10.0.0.1")
+	if list := h.get("10.0.0.1", now); len(list) != 0 {
+		t.Errorf("Cleared history must be empty, got %v", list)
+	}
+}
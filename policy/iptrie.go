@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"net"
+	"strings"
+)
+
+/* Binary trie over address bits, IPv4 is stored as IPv4-mapped IPv6, so both
+ * families share one tree. Lookup walks at most 128 nodes whatever the number
+ * of entries, and stops at the first prefix covering the address.
+ */
+type ipTrie struct {
+	root *ipTrieNode
+}
+
+type ipTrieNode struct {
+	child [2]*ipTrieNode
+	leaf  bool
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{root: &ipTrieNode{}}
+}
+
+// Accepts single address, IPv4 CIDR or IPv6 prefix such as 2001:db8::/64
+func parseIPEntry(entry string) (*net.IPNet, bool) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		return n, err == nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
+
+func (t *ipTrie) insert(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip := n.IP.To16()
+	node := t.root
+	for i := 0; i < ones; i++ {
+		if node.leaf {
+			// Already covered by a wider prefix
+			return
+		}
+		b := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[b] == nil {
+			node.child[b] = &ipTrieNode{}
+		}
+		node = node.child[b]
+	}
+	node.leaf = true
+	node.child = [2]*ipTrieNode{}
+}
+
+func (t *ipTrie) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.leaf {
+			return true
+		}
+		if i == 128 {
+			break
+		}
+		node = node.child[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	return false
+}
+
+func (t *ipTrie) containsString(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && t.contains(parsed)
+}
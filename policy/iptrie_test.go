@@ -0,0 +1,45 @@
+package policy
+
+import "testing"
+
+func TestIPTrie(t *testing.T) {
+	trie := newIPTrie()
+	for _, entry := range []string{"10.0.0.0/8", "192.168.1.7", "2001:db8:1:2::/64", "::1"} {
+		n, ok := parseIPEntry(entry)
+		if !ok {
+			t.Fatalf("Failed to parse %v", entry)
+		}
+		trie.insert(n)
+	}
+	if _, ok := parseIPEntry("0xb85150eb365e7df0941f0cf08235f987ba91506a"); ok {
+		t.Error("Address must not parse as IP entry")
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8:1:2:abcd::1", true},
+		{"2001:db8:1:3::1", false},
+		{"::1", true},
+		{"::2", false},
+		{"not an ip", false},
+	}
+	for _, tt := range tests {
+		if trie.containsString(tt.ip) != tt.contains {
+			t.Errorf("containsString(%v) must be %v", tt.ip, tt.contains)
+		}
+	}
+
+	// Wider prefix covers narrower ones inserted before
+	n, _ := parseIPEntry("192.168.0.0/16")
+	trie.insert(n)
+	if !trie.containsString("192.168.200.1") {
+		t.Error("Expected 192.168.0.0/16 to be covered")
+	}
+}
@@ -1,9 +1,7 @@
 package policy
 
 import (
-	"fmt"
 	"log"
-	"os/exec"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -29,12 +27,24 @@ type Limits struct {
 }
 
 type Banning struct {
-	Enabled        bool    `json:"enabled"`
-	IPSet          string  `json:"ipset"`
+	Enabled bool `json:"enabled"`
+	// One of ipset, nftables, iptables, memory and script
+	Backend       string `json:"backend"`
+	Sudo          bool   `json:"sudo"`
+	IPSet         string `json:"ipset"`
+	NFTable       string `json:"nftTable"`
+	NFSet         string `json:"nftSet"`
+	IPTablesChain string `json:"iptablesChain"`
+	Script        string `json:"script"`
+
 	Timeout        int64   `json:"timeout"`
 	InvalidPercent float32 `json:"invalidPercent"`
 	CheckThreshold int32   `json:"checkThreshold"`
 	MalformedLimit int32   `json:"malformedLimit"`
+	// Repeat offenders are banned for timeout * multiplier^offences, up to maxTimeout
+	Multiplier    float64 `json:"multiplier"`
+	MaxTimeout    int64   `json:"maxTimeout"`
+	HistoryWindow string  `json:"historyWindow"`
 }
 
 type Stats struct {
@@ -43,6 +53,7 @@ type Stats struct {
 	// so moving it before the rest in order to avoid alignment issue
 	LastBeat      int64
 	BannedAt      int64
+	BanExpiresAt  int64
 	ValidShares   int32
 	InvalidShares int32
 	Malformed     int32
@@ -50,27 +61,69 @@ type Stats struct {
 	Banned        int32
 }
 
+type banOp struct {
+	ip        string
+	unban     bool
+	reason    string
+	bannedAt  int64
+	expiresAt int64
+	// Ban of another instance, already in backend
+	remote bool
+}
+
 type PolicyServer struct {
 	sync.RWMutex
 	statsMu    sync.Mutex
 	config     *Config
+	name       string
 	stats      map[string]*Stats
-	banChannel chan string
+	banChannel chan banOp
+	history    *offenceHistory
+	backend    BanBackend
 	startedAt  int64
 	grace      int64
 	timeout    int64
-	blacklist  []string
-	whitelist  []string
-	storage    *storage.RedisClient
+	// Blacklist holds both miner addresses and IP ranges
+	blacklist map[string]struct{}
+	blackNets *ipTrie
+	whitelist *ipTrie
+	storage   *storage.RedisClient
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+// Name identifies proxy instance in bans shared with other instances
+func Start(cfg *Config, storage *storage.RedisClient, name string) *PolicyServer {
+	s := &PolicyServer{config: cfg, name: name, startedAt: util.MakeTimestamp()}
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
-	s.banChannel = make(chan string, 64)
+	s.banChannel = make(chan banOp, 64)
 	s.stats = make(map[string]*Stats)
 	s.storage = storage
+	s.blacklist = make(map[string]struct{})
+	s.blackNets = newIPTrie()
+	s.whitelist = newIPTrie()
+
+	historyWindow := defaultHistoryWindow
+	if len(cfg.Banning.HistoryWindow) > 0 {
+		historyWindow = util.MustParseDuration(cfg.Banning.HistoryWindow)
+	}
+	s.history = newOffenceHistory(historyWindow)
+	if cfg.Banning.Enabled && cfg.Banning.Multiplier > 1 {
+		log.Printf("Ban timeout grows %v times per offence within %v, up to %vs", cfg.Banning.Multiplier, historyWindow, cfg.Banning.MaxTimeout)
+	}
+
+	if cfg.Banning.Enabled {
+		backend, err := newBanBackend(&cfg.Banning)
+		if err != nil {
+			log.Fatalf("Failed to set up banning: %v", err)
+		}
+		s.backend = backend
+		logBackend(backend)
+	}
+	for i := 0; i < s.config.Workers; i++ {
+		s.startPolicyWorker()
+	}
+	log.Printf("Running with %v policy workers", s.config.Workers)
+	// Bans in force are loaded along with lists
 	s.refreshState()
 
 	timeout := util.MustParseDuration(s.config.ResetInterval)
@@ -97,62 +150,141 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
-		s.startPolicyWorker()
-	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
 	return s
 }
 
 func (s *PolicyServer) startPolicyWorker() {
 	go func() {
-		for ip := range s.banChannel {
-			s.doBan(ip)
+		for op := range s.banChannel {
+			if op.unban {
+				s.doUnban(op.ip)
+			} else {
+				s.doBan(op)
+			}
 		}
 	}()
 }
 
 func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
-	banningTimeout := s.config.Banning.Timeout * 1000
 	total := 0
+	var unbanned []string
 	s.statsMu.Lock()
-	defer s.statsMu.Unlock()
 
 	for key, m := range s.stats {
 		lastBeat := atomic.LoadInt64(&m.LastBeat)
-		bannedAt := atomic.LoadInt64(&m.BannedAt)
+		expiresAt := atomic.LoadInt64(&m.BanExpiresAt)
 
-		if now-bannedAt >= banningTimeout {
+		if now >= expiresAt {
 			atomic.StoreInt64(&m.BannedAt, 0)
 			if atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
 				log.Printf("Ban dropped for %v", key)
 				delete(s.stats, key)
+				unbanned = append(unbanned, key)
 				total++
 			}
 		}
-		if now-lastBeat >= s.timeout {
+		// Ban outlives idle timeout, banned miners usually stop showing up
+		if now-lastBeat >= s.timeout && atomic.LoadInt32(&m.Banned) == 0 {
 			delete(s.stats, key)
 			total++
 		}
 	}
+	s.statsMu.Unlock()
 	log.Printf("Flushed stats for %v IP addresses", total)
+	if n := s.history.prune(now); n > 0 {
+		log.Printf("Forgot offences of %v IP addresses", n)
+	}
+
+	// Firewall rules without own expiration are lifted here
+	if s.backend != nil {
+		for _, ip := range unbanned {
+			s.banChannel <- banOp{ip: ip, unban: true}
+		}
+	}
 }
 
 func (s *PolicyServer) refreshState() {
+	s.refreshLists()
+	if s.config.Banning.Enabled {
+		s.refreshBans()
+	}
+	log.Println("Policy state refresh complete")
+}
+
+// Lists are rebuilt aside and swapped, so lookups do not wait for backend
+func (s *PolicyServer) refreshLists() {
+	blacklist, blacklistErr := s.storage.GetBlacklist()
+	if blacklistErr != nil {
+		log.Printf("Failed to get blacklist from backend: %v", blacklistErr)
+	}
+	whitelist, whitelistErr := s.storage.GetWhitelist()
+	if whitelistErr != nil {
+		log.Printf("Failed to get whitelist from backend: %v", whitelistErr)
+	}
+
 	s.Lock()
 	defer s.Unlock()
-	var err error
+	if blacklistErr == nil {
+		s.blacklist = make(map[string]struct{})
+		s.blackNets = newIPTrie()
+		for _, entry := range blacklist {
+			if n, ok := parseIPEntry(entry); ok {
+				s.blackNets.insert(n)
+			} else {
+				s.blacklist[strings.ToLower(entry)] = struct{}{}
+			}
+		}
+	}
+	if whitelistErr == nil {
+		s.whitelist = newIPTrie()
+		for _, entry := range whitelist {
+			if n, ok := parseIPEntry(entry); ok {
+				s.whitelist.insert(n)
+			} else {
+				log.Printf("Ignoring malformed whitelist entry %q", entry)
+			}
+		}
+	}
+}
 
-	s.blacklist, err = s.storage.GetBlacklist()
+// Picks up bans of other instances and our own from before restart
+func (s *PolicyServer) refreshBans() {
+	lifted, err := s.storage.GetLiftedBans()
 	if err != nil {
-		log.Printf("Failed to get blacklist from backend: %v", err)
+		log.Printf("Failed to get lifted bans from backend: %v", err)
 	}
-	s.whitelist, err = s.storage.GetWhitelist()
+	for ip, liftedAt := range lifted {
+		if s.liftLocalBan(ip, liftedAt) {
+			log.Printf("Ban of %v lifted on another instance", ip)
+		}
+	}
+
+	bans, err := s.storage.GetBans()
 	if err != nil {
-		log.Printf("Failed to get whitelist from backend: %v", err)
+		log.Printf("Failed to get bans from backend: %v", err)
+		return
+	}
+	for _, ban := range bans {
+		s.applyBan(ban)
+	}
+}
+
+func (s *PolicyServer) applyBan(ban *storage.BanEntry) {
+	if s.InWhiteList(ban.IP) {
+		return
+	}
+	x := s.Get(ban.IP)
+	if atomic.LoadInt32(&x.Banned) > 0 {
+		return
+	}
+	op := banOp{ip: ban.IP, reason: ban.Reason, bannedAt: ban.BannedAt * 1000, expiresAt: ban.ExpiresAt * 1000, remote: true}
+	atomic.StoreInt64(&x.BannedAt, op.bannedAt)
+	atomic.StoreInt64(&x.BanExpiresAt, op.expiresAt)
+	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+		log.Printf("Applying ban of %v by %v: %v", ban.IP, ban.Instance, ban.Reason)
+		s.banChannel <- op
 	}
-	log.Println("Policy state refresh complete")
 }
 
 func (s *PolicyServer) NewStats() *Stats {
@@ -177,12 +309,15 @@ func (s *PolicyServer) Get(ip string) *Stats {
 	}
 }
 
-func (s *PolicyServer) BanClient(ip string) {
+func (s *PolicyServer) BanClient(ip, reason string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, reason)
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
+	if s.inBlackNets(ip) && !s.InWhiteList(ip) {
+		return true
+	}
 	x := s.Get(ip)
 	return atomic.LoadInt32(&x.Banned) > 0
 }
@@ -201,7 +336,7 @@ func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
 func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, "blacklisted login")
 		return false
 	}
 	return true
@@ -211,7 +346,7 @@ func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
 	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, "malformed requests")
 		return false
 	}
 	return true
@@ -243,7 +378,7 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 	ratio := invalidShares / validShares
 
 	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, "invalid shares")
 		return false
 	}
 	return true
@@ -254,19 +389,41 @@ func (x *Stats) resetShares() {
 	x.InvalidShares = 0
 }
 
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
+func (s *PolicyServer) forceBan(x *Stats, ip, reason string) {
 	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
-	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+	// Ban in force is not extended, so it does not escalate on every bad request
+	if atomic.LoadInt32(&x.Banned) > 0 {
+		return
+	}
+	now := util.MakeTimestamp()
+	timeout := banTimeout(&s.config.Banning, len(s.offences(ip, now)))
+	expiresAt := now + timeout*1000
+	atomic.StoreInt64(&x.BannedAt, now)
+	atomic.StoreInt64(&x.BanExpiresAt, expiresAt)
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
-			s.banChannel <- ip
+		s.history.add(ip, Offence{At: now, Reason: reason, Timeout: timeout, Instance: s.name})
+		s.banChannel <- banOp{ip: ip, reason: reason, bannedAt: now, expiresAt: expiresAt}
+	}
+}
+
+// Offences recorded by any instance, local history is used if backend fails
+func (s *PolicyServer) offences(ip string, now int64) []Offence {
+	if s.storage != nil {
+		entries, err := s.storage.GetOffences(ip, (now-s.history.window)/1000)
+		if err != nil {
+			log.Printf("Failed to get offences of %v from backend: %v", ip, err)
 		} else {
-			log.Println("Banned peer", ip)
+			list := make([]Offence, len(entries))
+			for i, e := range entries {
+				list[i] = Offence{At: e.At * 1000, Reason: e.Reason, Timeout: e.Timeout, Instance: e.Instance}
+			}
+			s.history.set(ip, list)
 		}
 	}
+	return s.history.get(ip, now)
 }
 
 func (x *Stats) incrLimit(n int32) {
@@ -284,28 +441,62 @@ func (x *Stats) decrLimit() int32 {
 func (s *PolicyServer) InBlackList(addy string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(addy, s.blacklist)
+	_, ok := s.blacklist[strings.ToLower(addy)]
+	return ok
+}
+
+// Blacklisted IP ranges are refused without waiting for a ban
+func (s *PolicyServer) inBlackNets(ip string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.blackNets.containsString(ip)
 }
 
 func (s *PolicyServer) InWhiteList(ip string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(ip, s.whitelist)
+	return s.whitelist.containsString(ip)
 }
 
-func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
-	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
-	args := strings.Fields(cmd)
-	head := args[0]
-	args = args[1:]
+// Own bans are shared with other instances through backend
+func (s *PolicyServer) doBan(op banOp) {
+	timeout := time.Duration(op.expiresAt-util.MakeTimestamp()) * time.Millisecond
+	// Zero timeout means forever to ipset
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	if err := s.backend.Ban(op.ip, timeout); err != nil {
+		log.Printf("Failed to ban %v: %v", op.ip, err)
+	} else {
+		log.Printf("Banned %v with timeout %v: %v", op.ip, timeout, op.reason)
+	}
+	if op.remote {
+		return
+	}
+	ban := &storage.BanEntry{
+		IP:        op.ip,
+		BannedAt:  op.bannedAt / 1000,
+		ExpiresAt: op.expiresAt / 1000,
+		Instance:  s.name,
+		Reason:    op.reason,
+	}
+	if err := s.storage.WriteBan(ban, time.Duration(s.history.window)*time.Millisecond); err != nil {
+		log.Printf("Failed to write ban of %v to backend: %v", op.ip, err)
+	}
+}
 
-	log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, set)
+func (s *PolicyServer) doUnban(ip string) {
+	if err := s.backend.Unban(ip); err != nil {
+		log.Printf("Failed to unban %v: %v", ip, err)
+	}
+}
 
-	_, err := exec.Command(head, args...).Output()
-	if err != nil {
-		log.Printf("CMD Error: %s", err)
+// Addresses currently banned by backend
+func (s *PolicyServer) ListBans() ([]string, error) {
+	if s.backend == nil {
+		return nil, nil
 	}
+	return s.backend.List()
 }
 
 func (x *Stats) heartbeat() {
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/virbicoin/open-virbicoin-pool/policy"
+)
+
+type AdminSession struct {
+	Id          uint64 `json:"id"`
+	Login       string `json:"login"`
+	Worker      string `json:"worker"`
+	IP          string `json:"ip"`
+	Port        string `json:"port"`
+	Solo        bool   `json:"solo"`
+	ConnectedAt int64  `json:"connectedAt"`
+	LastShare   int64  `json:"lastShare"`
+	Difficulty  int64  `json:"difficulty"`
+}
+
+func (s *ProxyServer) listenAdmin() {
+	cfg := &s.config.Proxy.Admin
+	if len(cfg.Token) == 0 {
+		log.Fatal("Admin API requires token to be set")
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/sessions", s.adminAuth(s.AdminSessionsIndex)).Methods("GET")
+	r.HandleFunc("/admin/sessions/{id:[0-9]+}/kick", s.adminAuth(s.AdminKickSession)).Methods("POST")
+	r.HandleFunc("/admin/sessions/{id:[0-9]+}/reconnect", s.adminAuth(s.AdminReconnectSession)).Methods("POST")
+	r.HandleFunc("/admin/reconnect", s.adminAuth(s.AdminReconnectAll)).Methods("POST")
+	r.HandleFunc("/admin/bans", s.adminAuth(s.AdminBansIndex)).Methods("GET")
+	r.HandleFunc("/admin/bans/{ip}/lift", s.adminAuth(s.AdminLiftBan)).Methods("POST")
+	r.HandleFunc("/admin/offences", s.adminAuth(s.AdminOffencesIndex)).Methods("GET")
+	r.HandleFunc("/admin/blacklist", s.adminAuth(s.AdminBlacklist)).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/admin/whitelist", s.adminAuth(s.AdminWhitelist)).Methods("GET", "POST", "DELETE")
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatalf("Failed to start admin API: %v", err)
+	}
+	// Closed on Stop along with stratum listeners
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.listenersMu.Unlock()
+	select {
+	case <-s.quit:
+		ln.Close()
+		return
+	default:
+	}
+
+	log.Printf("Admin API listening on %s", cfg.Listen)
+	srv := &http.Server{Handler: r, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	if err := srv.Serve(ln); err != nil {
+		select {
+		case <-s.quit:
+		default:
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}
+}
+
+// Token is passed as "Authorization: Bearer <token>"
+func (s *ProxyServer) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Proxy.Admin.Token)) != 1 {
+			log.Printf("Unauthorized admin request from %s", r.RemoteAddr)
+			writeAdminReply(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Error serializing admin API response: ", err)
+	}
+}
+
+// Optional login query param narrows list down to one miner
+func (s *ProxyServer) AdminSessionsIndex(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(r.URL.Query().Get("login"))
+	result := []AdminSession{}
+
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		if len(login) > 0 && cs.login != login {
+			continue
+		}
+		result = append(result, cs.adminInfo())
+	}
+	s.sessionsMu.RUnlock()
+
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"sessions": result, "total": len(result)})
+}
+
+func (s *ProxyServer) AdminKickSession(w http.ResponseWriter, r *http.Request) {
+	cs := s.findSession(mux.Vars(r)["id"])
+	if cs == nil {
+		writeAdminReply(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	log.Printf("Admin kicked stratum session %v from %v", cs.id, cs.ip)
+	cs.conn.Close()
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"kicked": cs.id})
+}
+
+// Params are host, port and optional wait in seconds
+func (s *ProxyServer) AdminReconnectSession(w http.ResponseWriter, r *http.Request) {
+	host, port, wait, ok := parseReconnect(w, r)
+	if !ok {
+		return
+	}
+	cs := s.findSession(mux.Vars(r)["id"])
+	if cs == nil {
+		writeAdminReply(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	log.Printf("Admin reconnects stratum session %v from %v to %v:%v", cs.id, cs.ip, host, port)
+	cs.reconnect(host, port, wait)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"reconnected": 1})
+}
+
+// Moves every miner, or every miner of login, elsewhere before maintenance
+func (s *ProxyServer) AdminReconnectAll(w http.ResponseWriter, r *http.Request) {
+	host, port, wait, ok := parseReconnect(w, r)
+	if !ok {
+		return
+	}
+	login := strings.ToLower(r.URL.Query().Get("login"))
+
+	var sessions []*Session
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		if len(login) == 0 || cs.login == login {
+			sessions = append(sessions, cs)
+		}
+	}
+	s.sessionsMu.RUnlock()
+
+	log.Printf("Admin reconnects %v stratum sessions to %v:%v", len(sessions), host, port)
+	for _, cs := range sessions {
+		go cs.reconnect(host, port, wait)
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"reconnected": len(sessions)})
+}
+
+func (s *ProxyServer) AdminBansIndex(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.policy.Bans()
+	if err != nil {
+		log.Printf("Failed to get shared bans from backend: %v", err)
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"bans": bans, "total": len(bans)})
+}
+
+func (s *ProxyServer) AdminOffencesIndex(w http.ResponseWriter, r *http.Request) {
+	offences := s.policy.Offences()
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"offences": offences, "total": len(offences)})
+}
+
+func (s *ProxyServer) AdminLiftBan(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if net.ParseIP(ip) == nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "invalid IP address"})
+		return
+	}
+	if err := s.policy.LiftBan(ip); err != nil {
+		log.Printf("Failed to lift ban of %v in backend: %v", ip, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": "failed to lift ban in backend"})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"lifted": ip})
+}
+
+// GET lists entries, POST adds and DELETE removes entry given in entry query param
+func (s *ProxyServer) AdminBlacklist(w http.ResponseWriter, r *http.Request) {
+	s.adminPolicyList(w, r, "blacklist", s.backend.GetBlacklist, s.policy.UpdateBlacklist)
+}
+
+func (s *ProxyServer) AdminWhitelist(w http.ResponseWriter, r *http.Request) {
+	s.adminPolicyList(w, r, "whitelist", s.backend.GetWhitelist, s.policy.UpdateWhitelist)
+}
+
+func (s *ProxyServer) adminPolicyList(w http.ResponseWriter, r *http.Request, list string, get func() ([]string, error), update func(string, bool) error) {
+	if r.Method == "GET" {
+		entries, err := get()
+		if err != nil {
+			log.Printf("Failed to get %v from backend: %v", list, err)
+			writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": "failed to get " + list})
+			return
+		}
+		writeAdminReply(w, http.StatusOK, map[string]interface{}{list: entries, "total": len(entries)})
+		return
+	}
+	entry := r.URL.Query().Get("entry")
+	err := update(entry, r.Method == "POST")
+	if err == policy.ErrInvalidEntry {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "invalid entry for " + list})
+		return
+	} else if err != nil {
+		log.Printf("Failed to update %v in backend: %v", list, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": "failed to update " + list})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"entry": entry, "added": r.Method == "POST"})
+}
+
+func parseReconnect(w http.ResponseWriter, r *http.Request) (string, string, int, bool) {
+	q := r.URL.Query()
+	host, port := q.Get("host"), q.Get("port")
+	wait, err := strconv.Atoi(q.Get("wait"))
+	if len(q.Get("wait")) == 0 {
+		wait, err = 0, nil
+	}
+	if _, perr := strconv.ParseUint(port, 10, 16); len(host) == 0 || perr != nil || err != nil || wait < 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "host, port and optional wait are required"})
+		return "", "", 0, false
+	}
+	return host, port, wait, true
+}
+
+func (s *ProxyServer) findSession(id string) *Session {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for cs := range s.sessions {
+		if cs.id == n {
+			return cs
+		}
+	}
+	return nil
+}
+
+// Must be called with sessionsMu held
+func (cs *Session) adminInfo() AdminSession {
+	info := AdminSession{
+		Id:          cs.id,
+		Login:       cs.login,
+		Worker:      cs.worker,
+		IP:          cs.ip,
+		Solo:        cs.solo,
+		ConnectedAt: cs.connectedAt,
+		LastShare:   atomic.LoadInt64(&cs.lastShare),
+		Difficulty:  cs.vardiff.current(),
+	}
+	if cs.port != nil {
+		info.Port = cs.port.name
+	}
+	return info
+}
+
+/* Asks miner to connect to another host, closing connection afterwards
+ * also moves miners that do not understand client.reconnect to their failover.
+ */
+func (cs *Session) reconnect(host, port string, wait int) {
+	cs.Lock()
+	if err := cs.conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		log.Printf("Failed to set deadline: %v", err)
+	}
+	message := JSONNotifyMessage{Method: "client.reconnect", Params: []interface{}{host, port, wait}}
+	if err := cs.enc.Encode(&message); err != nil {
+		log.Printf("Failed to send reconnect to %v: %v", cs.ip, err)
+	}
+	cs.Unlock()
+	cs.conn.Close()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/virbicoin/open-virbicoin-pool/policy"
+)
+
+func testAdminRequest(s *ProxyServer, method, url, token string, handler http.HandlerFunc, route string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc(route, s.adminAuth(handler))
+	req := httptest.NewRequest(method, url, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminSessions(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	s.config.Proxy.Admin.Token = "secret"
+	s.sessions = make(map[*Session]string)
+	s.loginSessions = make(map[string]int)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{id: 7, ip: "10.0.0.1", conn: server, enc: json.NewEncoder(server), vardiff: newVarDiff(1000, nil)}
+	s.registerSession(cs, "0x1", "rig1", false)
+
+	if w := testAdminRequest(s, "GET", "/admin/sessions", "wrong", s.AdminSessionsIndex, "/admin/sessions"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Request with wrong token must be rejected, got %v", w.Code)
+	}
+
+	w := testAdminRequest(s, "GET", "/admin/sessions?login=0x1", "secret", s.AdminSessionsIndex, "/admin/sessions")
+	var reply struct {
+		Sessions []AdminSession `json:"sessions"`
+	}
+	json.NewDecoder(w.Body).Decode(&reply)
+	if len(reply.Sessions) != 1 || reply.Sessions[0].Worker != "rig1" || reply.Sessions[0].Difficulty != 1000 {
+		t.Fatalf("Must list session, got %v", reply.Sessions)
+	}
+
+	done := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		done <- line
+	}()
+	route := "/admin/sessions/{id:[0-9]+}/reconnect"
+	if w := testAdminRequest(s, "POST", "/admin/sessions/7/reconnect?host=backup&port=8008", "secret", s.AdminReconnectSession, route); w.Code != http.StatusOK {
+		t.Fatalf("Reconnect failed with %v", w.Code)
+	}
+	if line := <-done; line != `{"id":null,"method":"client.reconnect","params":["backup","8008",0]}`+"\n" {
+		t.Errorf("Wrong reconnect message %q", line)
+	}
+	if w := testAdminRequest(s, "POST", "/admin/sessions/8/reconnect?host=backup&port=8008", "secret", s.AdminReconnectSession, route); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown session must not be found, got %v", w.Code)
+	}
+}
+
+func TestAdminPolicyListValidation(t *testing.T) {
+	s := &ProxyServer{config: &Config{}, policy: &policy.PolicyServer{}}
+	s.config.Proxy.Admin.Token = "secret"
+
+	tests := []struct {
+		url     string
+		handler http.HandlerFunc
+	}{
+		{"/admin/whitelist?entry=0xb85150eb365e7df0941f0cf08235f987ba91506a", s.AdminWhitelist},
+		{"/admin/whitelist?entry=10.0.0.0/33", s.AdminWhitelist},
+		{"/admin/blacklist?entry=0x0", s.AdminBlacklist},
+		{"/admin/blacklist?entry=", s.AdminBlacklist},
+	}
+	for _, tt := range tests {
+		if w := testAdminRequest(s, "POST", tt.url, "secret", tt.handler, "/admin/{list}"); w.Code != http.StatusBadRequest {
+			t.Errorf("Invalid entry %v must be rejected, got %v", tt.url, w.Code)
+		}
+	}
+	if w := testAdminRequest(s, "POST", "/admin/bans/nope/lift", "secret", s.AdminLiftBan, "/admin/bans/{ip}/lift"); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid IP must be rejected, got %v", w.Code)
+	}
+}
@@ -17,6 +17,8 @@ const maxBacklog = 3
 type heightDiffPair struct {
 	diff   *big.Int
 	height uint64
+	// When a job of higher height replaced this one, in ms
+	supersededAt int64
 }
 
 type BlockTemplate struct {
@@ -78,14 +80,22 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		height: height,
 	}
 	if t != nil {
+		now := util.MakeTimestamp()
 		for k, v := range t.headers {
 			if v.height > height-maxBacklog {
+				if v.height < height && v.supersededAt == 0 {
+					v.supersededAt = now
+				}
 				newTemplate.headers[k] = v
 			}
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
 	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	s.signalNewJob()
+	if s.epochs != nil {
+		s.epochs.update(height)
+	}
 
 	// Stratum
 	if s.config.Proxy.Stratum.Enabled {
@@ -13,9 +13,14 @@ type Config struct {
 	Api                   api.ApiConfig `json:"api"`
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	// Switch away from upstream falling this many blocks behind the best one
+	UpstreamMaxLag uint64 `json:"upstreamMaxLag"`
 
 	Threads int `json:"threads"`
 
+	// Time given to modules to finish work in progress on SIGINT or SIGTERM
+	ShutdownTimeout string `json:"shutdownTimeout"`
+
 	Coin  string         `json:"coin"`
 	Redis storage.Config `json:"redis"`
 
@@ -34,28 +39,90 @@ type Proxy struct {
 	LimitHeadersSize     int    `json:"limitHeadersSize"`
 	LimitBodySize        int64  `json:"limitBodySize"`
 	BehindReverseProxy   bool   `json:"behindReverseProxy"`
+	ProxyProtocol        bool   `json:"proxyProtocol"`
 	BlockRefreshInterval string `json:"blockRefreshInterval"`
-	Difficulty           int64  `json:"difficulty"`
-	StateUpdateInterval  string `json:"stateUpdateInterval"`
-	HashrateExpiration   string `json:"hashrateExpiration"`
+	// Polling interval while active upstream is subscribed to new heads, empty to keep blockRefreshInterval
+	SubscribedRefreshInterval string `json:"subscribedRefreshInterval"`
+	Difficulty                int64  `json:"difficulty"`
+	StateUpdateInterval       string `json:"stateUpdateInterval"`
+	HashrateExpiration        string `json:"hashrateExpiration"`
+	// Hold eth_getWork of HTTP miners until a new job appears, empty to disable
+	LongPollTimeout string `json:"longPollTimeout"`
+	// Shares for a previous block accepted as stale within this window after it was found, empty to accept them as valid
+	StaleWindow       string `json:"staleWindow"`
+	CreditStaleShares bool   `json:"creditStaleShares"`
+	// Shares backend failed to take are kept in this file and replayed once it is back, empty to disable
+	ShareJournal string `json:"shareJournal"`
+	// Shares are aggregated in memory and written to backend once per interval, empty to write each share
+	ShareFlushInterval string `json:"shareFlushInterval"`
+	// Let miners opt into solo mining by adding "+solo" to their address
+	SoloLogin bool `json:"soloLogin"`
 
 	Policy policy.Config `json:"policy"`
 
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 
+	// Load balancers allowed to pass client address in PROXY header or X-Forwarded-For
+	TrustedProxies []string `json:"trustedProxies"`
+
 	Stratum Stratum `json:"stratum"`
+	VarDiff VarDiff `json:"varDiff"`
+	Admin   Admin   `json:"admin"`
 }
 
-type Stratum struct {
+// Private endpoint to manage live stratum sessions, never expose it to miners
+type Admin struct {
 	Enabled bool   `json:"enabled"`
 	Listen  string `json:"listen"`
-	Timeout string `json:"timeout"`
-	MaxConn int    `json:"maxConn"`
+	Token   string `json:"token"`
+}
+
+type VarDiff struct {
+	Enabled         bool    `json:"enabled"`
+	MinDiff         int64   `json:"minDiff"`
+	MaxDiff         int64   `json:"maxDiff"`
+	TargetTime      string  `json:"targetTime"`
+	RetargetTime    string  `json:"retargetTime"`
+	VariancePercent float64 `json:"variancePercent"`
+}
+
+type Stratum struct {
+	Enabled bool          `json:"enabled"`
+	Listen  string        `json:"listen"`
+	Timeout string        `json:"timeout"`
+	MaxConn int           `json:"maxConn"`
+	Ports   []StratumPort `json:"ports"`
+	// Hard caps on concurrent connections across all ports, whitelisted IPs are exempt
+	MaxConnPerIP        int `json:"maxConnPerIP"`
+	MaxSessionsPerLogin int `json:"maxSessionsPerLogin"`
+}
+
+// Zero values are inherited from stratum and proxy settings
+type StratumPort struct {
+	Name       string `json:"name"`
+	Listen     string `json:"listen"`
+	Difficulty int64  `json:"difficulty"`
+	VarDiff    bool   `json:"varDiff"`
+	Timeout    string `json:"timeout"`
+	MaxConn    int    `json:"maxConn"`
+	Protocol   string `json:"protocol"`
+
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// Every miner on this port mines solo
+	Solo bool `json:"solo"`
+
+	TLS               bool   `json:"tls"`
+	CertFile          string `json:"certFile"`
+	KeyFile           string `json:"keyFile"`
+	ClientCAFile      string `json:"clientCAFile"`
+	RequireClientCert bool   `json:"requireClientCert"`
 }
 
 type Upstream struct {
 	Name    string `json:"name"`
 	Url     string `json:"url"`
 	Timeout string `json:"timeout"`
+	// Optional websocket endpoint to subscribe to new blocks instead of polling
+	WsUrl string `json:"wsUrl"`
 }
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocks before epoch boundary to start generating verification cache of the next epoch
+const cacheWarmupBlocks = 1000
+
+const (
+	cacheCold    = "cold"
+	cacheWarming = "warming"
+	cacheReady   = "ready"
+)
+
+/* Tracks epoch of the current template and generates verification cache of the
+ * next epoch in background ahead of the boundary, so first shares of a new epoch
+ * do not wait for cache generation.
+ */
+type epochTracker struct {
+	sync.Mutex
+	epoch     uint64
+	next      uint64
+	nextState string
+	warm      func(epoch uint64)
+}
+
+func newEpochTracker(warm func(epoch uint64)) *epochTracker {
+	return &epochTracker{warm: warm}
+}
+
+// Called with height of every new template
+func (e *epochTracker) update(height uint64) {
+	epoch := height / epochLength
+	e.Lock()
+	defer e.Unlock()
+	e.epoch = epoch
+	if e.next <= epoch {
+		e.next = epoch + 1
+		e.nextState = cacheCold
+	}
+	if e.nextState != cacheCold || height+cacheWarmupBlocks < e.next*epochLength {
+		return
+	}
+	e.nextState = cacheWarming
+	log.Printf("Generating verification cache for epoch %v ahead of block %v", e.next, e.next*epochLength)
+	go e.generate(e.next)
+}
+
+func (e *epochTracker) generate(epoch uint64) {
+	start := time.Now()
+	e.warm(epoch)
+	elapsed := time.Since(start)
+
+	e.Lock()
+	if e.next == epoch {
+		e.nextState = cacheReady
+	}
+	e.Unlock()
+	log.Printf("Verification cache for epoch %v is ready in %s", epoch, elapsed)
+}
+
+// Returns current epoch, next epoch and state of its cache
+func (e *epochTracker) state() (uint64, uint64, string) {
+	e.Lock()
+	defer e.Unlock()
+	return e.epoch, e.next, e.nextState
+}
+
+/* Verifying a dummy share at the first block of epoch makes hasher generate
+ * and keep its cache. Hasher verifies HTTP and ethproxy shares and HTTP is
+ * always served, mixer verifies ethstratum shares and is warmed only if some
+ * stratum port may speak it. Either is warmed from config, not from use, so
+ * restart right before the boundary does not leave it cold.
+ */
+func warmVerificationCache(epoch uint64, ethStratum bool) {
+	hasher.Verify(Block{number: epoch * epochLength, difficulty: big.NewInt(1)})
+	if ethStratum {
+		mixer.warm(epoch)
+	}
+}
+
+// Ports without protocol detect it, so they may speak ethstratum too
+func usesEthStratum(cfg *Stratum) bool {
+	if !cfg.Enabled {
+		return false
+	}
+	if len(cfg.Ports) == 0 {
+		return true
+	}
+	for _, v := range cfg.Ports {
+		switch strings.ToLower(v.Protocol) {
+		case "", "ethstratum", "nicehash":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEpochTracker(t *testing.T) {
+	warmed := make(chan uint64, 1)
+	e := newEpochTracker(func(epoch uint64) { warmed <- epoch })
+
+	e.update(epochLength + 100)
+	if epoch, next, state := e.state(); epoch != 1 || next != 2 || state != cacheCold {
+		t.Errorf("Cache must stay cold far from boundary, got %v %v %v", epoch, next, state)
+	}
+
+	e.update(2*epochLength - cacheWarmupBlocks)
+	select {
+	case epoch := <-warmed:
+		if epoch != 2 {
+			t.Errorf("Expected epoch 2 to be warmed, got %v", epoch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cache of next epoch must be generated ahead of boundary")
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, state := e.state(); state == cacheReady {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, state := e.state(); state != cacheReady {
+		t.Errorf("Expected cache to be ready, got %v", state)
+	}
+
+	// Generated once per epoch
+	e.update(2*epochLength - 1)
+	select {
+	case <-warmed:
+		t.Error("Cache must not be generated twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	e.update(2 * epochLength)
+	if epoch, next, state := e.state(); epoch != 2 || next != 3 || state != cacheCold {
+		t.Errorf("Expected to move to the next epoch, got %v %v %v", epoch, next, state)
+	}
+}
+
+func TestUsesEthStratum(t *testing.T) {
+	cfg := &Stratum{Enabled: true, Ports: []StratumPort{{Protocol: "ethproxy"}}}
+	if usesEthStratum(cfg) {
+		t.Error("Ethproxy port must not need mixer cache")
+	}
+	cfg.Ports = append(cfg.Ports, StratumPort{})
+	if !usesEthStratum(cfg) {
+		t.Error("Port detecting protocol must need mixer cache")
+	}
+	cfg.Enabled = false
+	if usesEthStratum(cfg) {
+		t.Error("Disabled stratum must not need mixer cache")
+	}
+}
@@ -3,7 +3,9 @@ package proxy
 import (
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/virbicoin/open-virbicoin-pool/rpc"
 	"github.com/virbicoin/open-virbicoin-pool/util"
@@ -14,22 +16,68 @@ var noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
 var hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
 
+/* Miners login as "address", "address.worker" or "address.worker/email",
+ * password param is usually "x" but may carry email as well.
+ */
+func parseLogin(params []string) (login, worker, email string) {
+	parts := strings.Split(params[0], "/")
+	login = parts[0]
+	if i := strings.Index(login, "."); i >= 0 {
+		login, worker = login[:i], login[i+1:]
+	}
+	for _, v := range parts[1:] {
+		if strings.Contains(v, "@") {
+			email = v
+		} else if len(worker) == 0 {
+			worker = v
+		}
+	}
+	if len(email) == 0 && len(params) > 1 && strings.Contains(params[1], "@") {
+		email = params[1]
+	}
+	return strings.ToLower(login), worker, email
+}
+
+const soloSuffix = "+solo"
+
+func (s *ProxyServer) parseSolo(login string) (string, bool) {
+	if s.config.Proxy.SoloLogin && strings.HasSuffix(login, soloSuffix) {
+		return strings.TrimSuffix(login, soloSuffix), true
+	}
+	return login, false
+}
+
 // Stratum
 func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (bool, *ErrorReply) {
 	if len(params) == 0 {
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	login := strings.ToLower(params[0])
+	login, worker, _ := parseLogin(params)
+	login, solo := s.parseSolo(login)
 	if !util.IsValidHexAddress(login) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid login"}
 	}
 	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
-	cs.login = login
-	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	// Non-standard worker field is still honoured for old configs
+	if len(worker) == 0 {
+		worker = id
+	}
+	if !workerPattern.MatchString(worker) {
+		worker = "0"
+	}
+	solo = solo || (cs.port != nil && cs.port.solo)
+	if !s.registerSession(cs, login, worker, solo) {
+		log.Printf("Too many sessions for %v, rejected %v", login, cs.ip)
+		return false, &ErrorReply{Code: -1, Message: "Too many sessions for this login"}
+	}
+	if solo {
+		log.Printf("Stratum solo miner connected %v.%v@%v", login, worker, cs.ip)
+	} else {
+		log.Printf("Stratum miner connected %v.%v@%v", login, worker, cs.ip)
+	}
 	return true, nil
 }
 
@@ -38,7 +86,8 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	return []string{t.Header, t.Seed, s.diff}, nil
+	diff, _ := cs.vardiff.jobDiff(t.Header)
+	return []string{t.Header, t.Seed, util.GetTargetHex(diff)}, nil
 }
 
 // Stratum
@@ -50,6 +99,9 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 	if !ok {
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
+	if len(id) == 0 {
+		id = cs.worker
+	}
 	return s.handleSubmitRPC(cs, cs.login, id, params)
 }
 
@@ -66,18 +118,31 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		log.Printf("Malformed PoW result from %s@%s %v", login, cs.ip, params)
+		s.writeRejectedShare(login, id, "malformed")
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
+	if !s.beginShare() {
+		return false, &ErrorReply{Code: -1, Message: "Pool is shutting down"}
+	}
+	defer s.endShare()
+
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params)
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	shareDiff := cs.vardiff.shareDiff(params[1])
+	result := s.processShare(login, id, cs.ip, cs.solo, cs.proto == protoEthStratum, shareDiff, t, params)
 
-	if exist {
+	switch result {
+	case shareDuplicate:
+		s.policy.ApplySharePolicy(cs.ip, false)
 		log.Printf("Duplicate share from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
-	}
-
-	if !validShare {
+	case shareStale:
+		// Miner was just late, this must not lead to a ban
+		log.Printf("Stale share from %s@%s", login, cs.ip)
+		cs.vardiff.submit()
+		atomic.StoreInt64(&cs.lastShare, util.MakeTimestamp())
+		return s.config.Proxy.CreditStaleShares, nil
+	case shareInvalid:
+		ok := s.policy.ApplySharePolicy(cs.ip, false)
 		log.Printf("Invalid share from %s@%s", login, cs.ip)
 		// Bad shares limit reached, return error and close
 		if !ok {
@@ -85,7 +150,10 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		}
 		return false, nil
 	}
+	ok := s.policy.ApplySharePolicy(cs.ip, true)
 	log.Printf("Valid share from %s@%s", login, cs.ip)
+	cs.vardiff.submit()
+	atomic.StoreInt64(&cs.lastShare, util.MakeTimestamp())
 
 	if !ok {
 		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
@@ -93,6 +161,31 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	return true, nil
 }
 
+// Params are [hashrate, client id], hashrate is hex encoded H/s
+func (s *ProxyServer) handleSubmitHashrateRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	if len(params) == 0 || !strings.HasPrefix(params[0], "0x") {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
+	}
+	hashrate, err := strconv.ParseUint(params[0][2:], 16, 63)
+	if err != nil {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		return false, &ErrorReply{Code: -1, Message: "Invalid hashrate"}
+	}
+	// Nothing to attach report to until miner is logged in
+	if len(login) == 0 {
+		return true, nil
+	}
+	err = s.backend.WriteReportedHashrate(login, id, int64(hashrate), s.hashrateExpiration)
+	if err != nil {
+		log.Printf("Failed to write reported hashrate of %s.%s: %v", login, id, err)
+	}
+	return true, nil
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := s.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
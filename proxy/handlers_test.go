@@ -0,0 +1,39 @@
+package proxy
+
+import "testing"
+
+func TestParseLogin(t *testing.T) {
+	const address = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	tests := []struct {
+		params               []string
+		login, worker, email string
+	}{
+		{[]string{address}, address, "", ""},
+		{[]string{"0xB85150EB365E7DF0941F0CF08235F987BA91506A.rig01", "x"}, address, "rig01", ""},
+		{[]string{address + ".rig01/miner@example.com"}, address, "rig01", "miner@example.com"},
+		{[]string{address + "/rig02"}, address, "rig02", ""},
+		{[]string{address + ".rig01", "miner@example.com"}, address, "rig01", "miner@example.com"},
+	}
+	for _, tt := range tests {
+		login, worker, email := parseLogin(tt.params)
+		if login != tt.login || worker != tt.worker || email != tt.email {
+			t.Errorf("parseLogin(%v) = %v, %v, %v", tt.params, login, worker, email)
+		}
+	}
+}
+
+func TestParseSolo(t *testing.T) {
+	const address = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	s := &ProxyServer{config: &Config{}}
+	if login, solo := s.parseSolo(address + soloSuffix); solo || login != address+soloSuffix {
+		t.Error("Solo suffix must be ignored unless soloLogin is enabled")
+	}
+	s.config.Proxy.SoloLogin = true
+	login, _, _ := parseLogin([]string{address + "+SOLO.rig01"})
+	if login, solo := s.parseSolo(login); !solo || login != address {
+		t.Errorf("Must strip solo suffix, got %v %v", login, solo)
+	}
+	if _, solo := s.parseSolo(address); solo {
+		t.Error("Plain address must not mine solo")
+	}
+}
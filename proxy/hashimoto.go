@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/sha3"
+)
+
+/* EthereumStratum/1.0.0 miners never send the mix digest with a share, but
+ * eth_submitWork on the node wants it. This is a light-only port of hashimoto
+ * from go-ethereum's consensus/ethash, it recovers the mix digest for a
+ * (header, nonce) pair along with the result the share is verified by, so
+ * these shares are hashed once and never go to hasher.
+ */
+const (
+	datasetInitBytes   = 1 << 30
+	datasetGrowthBytes = 1 << 23
+	cacheInitBytes     = 1 << 24
+	cacheGrowthBytes   = 1 << 17
+	epochLength        = 30000
+	mixBytes           = 128
+	hashBytes          = 64
+	hashWords          = 16
+	datasetParents     = 256
+	cacheRounds        = 3
+	loopAccesses       = 64
+	maxLightCaches     = 2
+)
+
+type keccakHasher func(dest []byte, data []byte)
+
+type lightCache struct {
+	epoch   uint64
+	once    sync.Once
+	cache   []uint32
+	dataset uint64
+	used    time.Time
+}
+
+type mixHasher struct {
+	sync.Mutex
+	caches map[uint64]*lightCache
+}
+
+var mixer = &mixHasher{caches: make(map[uint64]*lightCache)}
+
+// Returns mix digest and PoW result for a given header hash and nonce at height
+func (m *mixHasher) compute(height uint64, hash common.Hash, nonce uint64) (common.Hash, common.Hash) {
+	c := m.getCache(height / epochLength)
+	mix, result := hashimotoLight(c.dataset, c.cache, hash.Bytes(), nonce)
+	return common.BytesToHash(mix), common.BytesToHash(result)
+}
+
+func (m *mixHasher) getCache(epoch uint64) *lightCache {
+	m.Lock()
+	c, ok := m.caches[epoch]
+	if !ok {
+		if len(m.caches) >= maxLightCaches {
+			var oldest *lightCache
+			for _, v := range m.caches {
+				if oldest == nil || v.used.Before(oldest.used) {
+					oldest = v
+				}
+			}
+			delete(m.caches, oldest.epoch)
+		}
+		c = &lightCache{epoch: epoch}
+		m.caches[epoch] = c
+	}
+	c.used = time.Now()
+	m.Unlock()
+
+	c.once.Do(c.generate)
+	return c
+}
+
+var pow256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// Result must not exceed 2^256 / difficulty
+func meetsTarget(result common.Hash, diff *big.Int) bool {
+	if diff.Sign() <= 0 {
+		return false
+	}
+	target := new(big.Int).Div(pow256, diff)
+	return new(big.Int).SetBytes(result.Bytes()).Cmp(target) <= 0
+}
+
+// Generates cache ahead of time
+func (m *mixHasher) warm(epoch uint64) {
+	m.getCache(epoch)
+}
+
+func (c *lightCache) generate() {
+	start := time.Now()
+	size := calcCacheSize(c.epoch)
+	c.cache = make([]uint32, size/4)
+	c.dataset = calcDatasetSize(c.epoch)
+	generateCache(c.cache, seedHash(c.epoch))
+	log.Printf("Generated light verification cache for epoch %v in %s", c.epoch, time.Since(start))
+}
+
+func calcCacheSize(epoch uint64) uint64 {
+	size := cacheInitBytes + cacheGrowthBytes*epoch - hashBytes
+	for !new(big.Int).SetUint64(size / hashBytes).ProbablyPrime(1) {
+		size -= 2 * hashBytes
+	}
+	return size
+}
+
+func calcDatasetSize(epoch uint64) uint64 {
+	size := datasetInitBytes + datasetGrowthBytes*epoch - mixBytes
+	for !new(big.Int).SetUint64(size / mixBytes).ProbablyPrime(1) {
+		size -= 2 * mixBytes
+	}
+	return size
+}
+
+func makeKeccakHasher(h hash.Hash) keccakHasher {
+	// Keccak state supports Read to get the sum without the overhead of Sum
+	type readerHash interface {
+		hash.Hash
+		Read([]byte) (int, error)
+	}
+	rh := h.(readerHash)
+	outputLen := rh.Size()
+	return func(dest []byte, data []byte) {
+		rh.Reset()
+		rh.Write(data)
+		rh.Read(dest[:outputLen])
+	}
+}
+
+func seedHash(epoch uint64) []byte {
+	seed := make([]byte, 32)
+	keccak256 := makeKeccakHasher(sha3.NewLegacyKeccak256())
+	for i := uint64(0); i < epoch; i++ {
+		keccak256(seed, seed)
+	}
+	return seed
+}
+
+func generateCache(dest []uint32, seed []byte) {
+	cache := make([]byte, len(dest)*4)
+	size := uint64(len(cache))
+	rows := int(size) / hashBytes
+
+	keccak512 := makeKeccakHasher(sha3.NewLegacyKeccak512())
+
+	// Sequentially produce the initial dataset
+	keccak512(cache, seed)
+	for offset := uint64(hashBytes); offset < size; offset += hashBytes {
+		keccak512(cache[offset:], cache[offset-hashBytes:offset])
+	}
+	// Use a low-round version of randmemohash
+	temp := make([]byte, hashBytes)
+	for i := 0; i < cacheRounds; i++ {
+		for j := 0; j < rows; j++ {
+			srcOff := ((j - 1 + rows) % rows) * hashBytes
+			dstOff := j * hashBytes
+			xorOff := int(binary.LittleEndian.Uint32(cache[dstOff:])%uint32(rows)) * hashBytes
+			for k := 0; k < hashBytes; k++ {
+				temp[k] = cache[srcOff+k] ^ cache[xorOff+k]
+			}
+			keccak512(cache[dstOff:], temp)
+		}
+	}
+	for i := range dest {
+		dest[i] = binary.LittleEndian.Uint32(cache[i*4:])
+	}
+}
+
+func fnv(a, b uint32) uint32 {
+	return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+	for i := 0; i < len(mix); i++ {
+		mix[i] = mix[i]*0x01000193 ^ data[i]
+	}
+}
+
+func generateDatasetItem(cache []uint32, index uint32, keccak512 keccakHasher) []uint32 {
+	rows := uint32(len(cache) / hashWords)
+
+	mix := make([]byte, hashBytes)
+	binary.LittleEndian.PutUint32(mix, cache[(index%rows)*hashWords]^index)
+	for i := 1; i < hashWords; i++ {
+		binary.LittleEndian.PutUint32(mix[i*4:], cache[(index%rows)*hashWords+uint32(i)])
+	}
+	keccak512(mix, mix)
+
+	intMix := make([]uint32, hashWords)
+	for i := 0; i < len(intMix); i++ {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	for i := uint32(0); i < datasetParents; i++ {
+		parent := fnv(index^i, intMix[i%16]) % rows
+		fnvHash(intMix, cache[parent*hashWords:])
+	}
+	for i, val := range intMix {
+		binary.LittleEndian.PutUint32(mix[i*4:], val)
+	}
+	keccak512(mix, mix)
+
+	for i := range intMix {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	return intMix
+}
+
+func hashimotoLight(size uint64, cache []uint32, hash []byte, nonce uint64) ([]byte, []byte) {
+	keccak512 := makeKeccakHasher(sha3.NewLegacyKeccak512())
+	rows := uint32(size / mixBytes)
+
+	// Combine header+nonce into a 64 byte seed
+	seed := make([]byte, 40)
+	copy(seed, hash)
+	binary.LittleEndian.PutUint64(seed[32:], nonce)
+	seed64 := make([]byte, hashBytes)
+	keccak512(seed64, seed)
+	seedHead := binary.LittleEndian.Uint32(seed64)
+
+	mix := make([]uint32, mixBytes/4)
+	for i := 0; i < len(mix); i++ {
+		mix[i] = binary.LittleEndian.Uint32(seed64[i%16*4:])
+	}
+	temp := make([]uint32, len(mix))
+	for i := 0; i < loopAccesses; i++ {
+		parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+		for j := uint32(0); j < mixBytes/hashBytes; j++ {
+			copy(temp[j*hashWords:], generateDatasetItem(cache, 2*parent+j, keccak512))
+		}
+		fnvHash(mix, temp)
+	}
+	// Compress mix
+	for i := 0; i < len(mix); i += 4 {
+		mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+	}
+	mix = mix[:len(mix)/4]
+
+	digest := make([]byte, common.HashLength)
+	for i, val := range mix {
+		binary.LittleEndian.PutUint32(digest[i*4:], val)
+	}
+	result := sha3.NewLegacyKeccak256()
+	result.Write(seed64)
+	result.Write(digest)
+	return digest, result.Sum(nil)
+}
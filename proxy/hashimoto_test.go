@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestCalcSizes(t *testing.T) {
+	if size := calcCacheSize(0); size != 16776896 {
+		t.Errorf("Cache size for epoch 0 must be 16776896, got %v", size)
+	}
+	if size := calcDatasetSize(0); size != 1073739904 {
+		t.Errorf("Dataset size for epoch 0 must be 1073739904, got %v", size)
+	}
+}
+
+func TestHashimotoLight(t *testing.T) {
+	cache := make([]uint32, 1024/4)
+	generateCache(cache, make([]byte, 32))
+
+	hash := hexutil.MustDecode("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	wantDigest := hexutil.MustDecode("0xe4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800")
+	wantResult := hexutil.MustDecode("0xd3539235ee2e6f8db665c0a72169f55b7f6c605712330b778ec3944f0eb5a557")
+
+	digest, result := hashimotoLight(32*1024, cache, hash, 0)
+	if !bytes.Equal(digest, wantDigest) {
+		t.Errorf("Digest mismatch: have %x, want %x", digest, wantDigest)
+	}
+	if !bytes.Equal(result, wantResult) {
+		t.Errorf("Result mismatch: have %x, want %x", result, wantResult)
+	}
+}
+
+func TestMeetsTarget(t *testing.T) {
+	// Target for difficulty 2 is 2^255
+	half := common.BigToHash(new(big.Int).Lsh(big.NewInt(1), 255))
+	if !meetsTarget(half, big.NewInt(2)) {
+		t.Error("Result equal to target must pass")
+	}
+	over := common.BigToHash(new(big.Int).Add(half.Big(), big.NewInt(1)))
+	if meetsTarget(over, big.NewInt(2)) {
+		t.Error("Result above target must fail")
+	}
+	if meetsTarget(common.Hash{}, big.NewInt(0)) {
+		t.Error("Zero difficulty must fail")
+	}
+}
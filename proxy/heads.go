@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/virbicoin/open-virbicoin-pool/rpc"
+)
+
+const resubscribeDelay = 5 * time.Second
+
+// Heads of other upstreams do not tell when active one has a new block
+func (s *ProxyServer) headsSubscribed() bool {
+	i := atomic.LoadInt32(&s.upstream)
+	return int(i) < len(s.subscribed) && atomic.LoadInt32(&s.subscribed[i]) == 1
+}
+
+// Keeps newHeads subscription to upstream alive, block template is polled while it's down
+func (s *ProxyServer) watchNewHeads(ctx context.Context, i int, url string) {
+	node := s.upstreams[i]
+	for {
+		err := s.followNewHeads(ctx, i, url)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("New heads subscription on %s failed, polling for new blocks: %v", node.Name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (s *ProxyServer) followNewHeads(ctx context.Context, i int, url string) error {
+	node := s.upstreams[i]
+	sub, err := rpc.SubscribeNewHeads(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	atomic.StoreInt32(&s.subscribed[i], 1)
+	defer atomic.StoreInt32(&s.subscribed[i], 0)
+	if sub.Pending != nil {
+		log.Printf("Subscribed to new heads and pending transactions on %s", node.Name)
+	} else {
+		log.Printf("Subscribed to new heads on %s", node.Name)
+	}
+
+	// Catch up with blocks missed while we were not subscribed
+	s.fetchBlockTemplate()
+
+	var lastPending time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case head := <-sub.Heads:
+			// Template is built on top of the head, so its height is one more
+			t := s.currentBlockTemplate()
+			if t == nil || uint64(head.Height()) >= t.Height {
+				s.fetchBlockTemplate()
+			}
+		case <-sub.Pending:
+			// New transactions change pending work, refresh no more often than polling would
+			if s.rpc() == node && time.Since(lastPending) >= s.pendingRefreshIntv {
+				s.fetchBlockTemplate()
+				lastPending = time.Now()
+			}
+		}
+	}
+}
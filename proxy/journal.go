@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/virbicoin/open-virbicoin-pool/storage"
+)
+
+const (
+	journalShare     = "share"
+	journalStale     = "stale"
+	journalSolo      = "solo"
+	journalBlock     = "block"
+	journalSoloBlock = "soloBlock"
+	journalPending   = "pending"
+)
+
+/* Share or block backend failed to take, written as one JSON line. Pending
+ * entry carries batched shares left in memory at shutdown.
+ */
+type journalEntry struct {
+	Kind      string   `json:"kind"`
+	Login     string   `json:"login"`
+	Id        string   `json:"id"`
+	Params    []string `json:"params"`
+	Diff      int64    `json:"diff"`
+	RoundDiff int64    `json:"roundDiff,omitempty"`
+	Height    uint64   `json:"height"`
+	Credit    bool     `json:"credit,omitempty"`
+	Timestamp int64    `json:"ts"`
+
+	Pending *storage.PendingShares `json:"pending,omitempty"`
+}
+
+/* Append-only file of shares and blocks backend failed to write. On replay
+ * the journal is moved aside, so new entries keep going into a fresh file,
+ * and the moved file is replayed in order until it is empty.
+ */
+type shareJournal struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+var errJournalClosed = errors.New("share journal is closed")
+
+func openShareJournal(path string) *shareJournal {
+	j := &shareJournal{path: path}
+	if err := j.open(); err != nil {
+		log.Fatalf("Failed to open share journal: %v", err)
+	}
+	if j.pending() {
+		log.Printf("Share journal %s has entries to replay", path)
+	}
+	return j
+}
+
+func (j *shareJournal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+func (j *shareJournal) replayPath() string {
+	return j.path + ".replay"
+}
+
+// Synced to disk right away, entry must survive a crash
+func (j *shareJournal) append(e *journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return errJournalClosed
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *shareJournal) pending() bool {
+	for _, path := range []string{j.replayPath(), j.path} {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves current journal aside unless previous replay is still unfinished
+func (j *shareJournal) rotate() error {
+	if _, err := os.Stat(j.replayPath()); err == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return errJournalClosed
+	}
+	if fi, err := j.file.Stat(); err != nil || fi.Size() == 0 {
+		return err
+	}
+	j.file.Close()
+	j.file = nil
+	if err := os.Rename(j.path, j.replayPath()); err != nil {
+		j.open()
+		return err
+	}
+	return j.open()
+}
+
+/* Feeds entries to fn in order and stops at first error, entries not replayed
+ * yet are kept for the next attempt. Returns number of entries replayed.
+ */
+func (j *shareJournal) replay(fn func(*journalEntry) error) (int, error) {
+	if err := j.rotate(); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(j.replayPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	// Pending shares of a busy pool go as one long line
+	scanner.Buffer(make([]byte, 4096), 64*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, line := range lines {
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// Torn write on crash, nothing to recover from it
+			log.Printf("Skipping malformed share journal entry: %v", err)
+			continue
+		}
+		if err := fn(&e); err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			return i, j.keep(lines[i:], err)
+		}
+	}
+	return len(lines), os.Remove(j.replayPath())
+}
+
+func (j *shareJournal) keep(lines [][]byte, cause error) error {
+	tmp := j.replayPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.replayPath()); err != nil {
+		return err
+	}
+	return cause
+}
+
+func (j *shareJournal) close() {
+	j.Lock()
+	defer j.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
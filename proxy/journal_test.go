@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestShareJournalReplay(t *testing.T) {
+	j := openShareJournal(filepath.Join(t.TempDir(), "shares.journal"))
+	defer j.close()
+	for _, login := range []string{"a", "b", "c"} {
+		if err := j.append(&journalEntry{Kind: journalShare, Login: login}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	var replayed []string
+	down := errors.New("backend is down")
+	n, err := j.replay(func(e *journalEntry) error {
+		if e.Login == "b" {
+			return down
+		}
+		replayed = append(replayed, e.Login)
+		return nil
+	})
+	if n != 1 || err != down {
+		t.Fatalf("Replay must stop at first failure, got %v %v", n, err)
+	}
+	// Share journaled during replay goes after older ones
+	j.append(&journalEntry{Kind: journalShare, Login: "d"})
+
+	for j.pending() {
+		if _, err := j.replay(func(e *journalEntry) error {
+			replayed = append(replayed, e.Login)
+			return nil
+		}); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+	}
+	if len(replayed) != 4 || replayed[0] != "a" || replayed[1] != "b" || replayed[2] != "c" || replayed[3] != "d" {
+		t.Errorf("Entries must be replayed once and in order, got %v", replayed)
+	}
+}
@@ -8,71 +8,281 @@ import (
 
 	ethash "github.com/fedimoss/ethereum-ethash"
 	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/virbicoin/open-virbicoin-pool/rpc"
+	"github.com/virbicoin/open-virbicoin-pool/util"
 )
 
 var hasher = ethash.New()
 
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
+const (
+	shareValid = iota
+	shareStale
+	shareInvalid
+	shareDuplicate
+)
+
+// Share of EthereumStratum miner lacks mix digest, it is set in params once recovered
+func (s *ProxyServer) processShare(login, id, ip string, solo, ethStratum bool, shareDiff int64, t *BlockTemplate, params []string) int {
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
 
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
 		log.Printf("Stale share from %v@%v", login, ip)
-		return false, false
+		s.writeRejectedShare(login, id, "unknownJob")
+		return shareInvalid
 	}
 
-	share := Block{
-		number:      h.height,
-		hashNoNonce: common.HexToHash(hashNoNonce),
-		difficulty:  big.NewInt(shareDiff),
-		nonce:       nonce,
-		mixDigest:   common.HexToHash(mixDigest),
+	// Job of the previous block is stale within window, older jobs are expired
+	result := shareValid
+	if s.staleWindow > 0 && h.height < t.Height {
+		if h.height+1 < t.Height || util.MakeTimestamp()-h.supersededAt > s.staleWindow {
+			log.Printf("Stale share out of window from %v@%v", login, ip)
+			s.writeRejectedShare(login, id, "expired")
+			return shareInvalid
+		}
+		result = shareStale
 	}
 
-	block := Block{
-		number:      h.height,
-		hashNoNonce: common.HexToHash(hashNoNonce),
-		difficulty:  h.diff,
-		nonce:       nonce,
-		mixDigest:   common.HexToHash(mixDigest),
+	var valid, found bool
+	if ethStratum {
+		// Hashimoto runs once, its result is checked against both targets
+		mix, pow := mixer.compute(h.height, common.HexToHash(hashNoNonce), nonce)
+		params[2] = mix.Hex()
+		valid = meetsTarget(pow, big.NewInt(shareDiff))
+		found = valid && meetsTarget(pow, h.diff)
+	} else {
+		share := Block{
+			number:      h.height,
+			hashNoNonce: common.HexToHash(hashNoNonce),
+			difficulty:  big.NewInt(shareDiff),
+			nonce:       nonce,
+			mixDigest:   common.HexToHash(mixDigest),
+		}
+
+		block := Block{
+			number:      h.height,
+			hashNoNonce: common.HexToHash(hashNoNonce),
+			difficulty:  h.diff,
+			nonce:       nonce,
+			mixDigest:   common.HexToHash(mixDigest),
+		}
+		valid = hasher.Verify(share)
+		found = valid && hasher.Verify(block)
 	}
 
-	if !hasher.Verify(share) {
-		return false, false
+	if !valid {
+		s.writeRejectedShare(login, id, "invalid")
+		return shareInvalid
 	}
 
-	if hasher.Verify(block) {
-		ok, err := s.rpc().SubmitBlock(params)
+	if found {
+		ok, err := s.submitBlock(params, h.height)
 		if err != nil {
 			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
 		} else if !ok {
 			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
-			return false, false
+			s.writeRejectedShare(login, id, "blockRejected")
+			return shareInvalid
 		} else {
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			var exist bool
+			var err error
+			kind := journalBlock
+			if solo {
+				kind = journalSoloBlock
+				exist, err = s.backend.WriteSoloBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			} else {
+				exist, err = s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			}
 			if exist {
-				return true, false
+				s.writeRejectedShare(login, id, "duplicate")
+				return shareDuplicate
 			}
 			if err != nil {
 				log.Println("Failed to insert block candidate into backend:", err)
+				s.journalShare(&journalEntry{Kind: kind, Login: login, Id: id, Params: params, Diff: shareDiff, RoundDiff: h.diff.Int64(), Height: h.height})
 			} else {
 				log.Printf("Inserted block %v to backend", h.height)
 			}
 			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
 		}
+	} else if result == shareStale {
+		credit := s.config.Proxy.CreditStaleShares && !solo
+		exist, err := s.backend.WriteStaleShare(login, id, params, shareDiff, h.height, credit, s.hashrateExpiration)
+		if exist {
+			s.writeRejectedShare(login, id, "duplicate")
+			return shareDuplicate
+		}
+		if err != nil {
+			log.Println("Failed to insert stale share data into backend:", err)
+			s.journalShare(&journalEntry{Kind: journalStale, Login: login, Id: id, Params: params, Diff: shareDiff, Height: h.height, Credit: credit})
+		}
+		return shareStale
+	} else if solo {
+		exist, err := s.backend.WriteSoloShare(login, id, params, shareDiff, h.height, s.hashrateExpiration)
+		if exist {
+			s.writeRejectedShare(login, id, "duplicate")
+			return shareDuplicate
+		}
+		if err != nil {
+			log.Println("Failed to insert solo share data into backend:", err)
+			s.journalShare(&journalEntry{Kind: journalSolo, Login: login, Id: id, Params: params, Diff: shareDiff, Height: h.height})
+		}
 	} else {
 		exist, err := s.backend.WriteShare(login, id, params, shareDiff, h.height, s.hashrateExpiration)
 		if exist {
-			return true, false
+			s.writeRejectedShare(login, id, "duplicate")
+			return shareDuplicate
 		}
 		if err != nil {
 			log.Println("Failed to insert share data into backend:", err)
+			s.journalShare(&journalEntry{Kind: journalShare, Login: login, Id: id, Params: params, Diff: shareDiff, Height: h.height})
+		}
+	}
+	return shareValid
+}
+
+func (s *ProxyServer) writeRejectedShare(login, id, reason string) {
+	err := s.backend.WriteRejectedShare(login, id, reason, s.hashrateExpiration)
+	if err != nil {
+		log.Printf("Failed to write rejected share of %s.%s: %v", login, id, err)
+	}
+}
+
+// Keeps share backend failed to take, so it is not lost
+func (s *ProxyServer) journalShare(e *journalEntry) {
+	if s.journal == nil {
+		return
+	}
+	e.Timestamp = util.MakeTimestamp()
+	if err := s.journal.append(e); err != nil {
+		log.Printf("Failed to write share journal, %s of %v at height %v is lost: %v", e.Kind, e.Login, e.Height, err)
+	}
+}
+
+/* Writes journaled shares into backend once it is back. Entries already
+ * written before failure are recognized by pow set and skipped.
+ */
+func (s *ProxyServer) replayJournal() {
+	if !s.journal.pending() {
+		return
+	}
+	n, err := s.journal.replay(s.replayJournalEntry)
+	if n > 0 {
+		log.Printf("Replayed %v entries from share journal", n)
+	}
+	if err != nil {
+		log.Printf("Share journal replay stopped: %v", err)
+	}
+}
+
+func (s *ProxyServer) replayJournalEntry(e *journalEntry) error {
+	var exist bool
+	var err error
+	switch e.Kind {
+	case journalShare:
+		exist, err = s.backend.WriteShare(e.Login, e.Id, e.Params, e.Diff, e.Height, s.hashrateExpiration)
+	case journalStale:
+		exist, err = s.backend.WriteStaleShare(e.Login, e.Id, e.Params, e.Diff, e.Height, e.Credit, s.hashrateExpiration)
+	case journalSolo:
+		exist, err = s.backend.WriteSoloShare(e.Login, e.Id, e.Params, e.Diff, e.Height, s.hashrateExpiration)
+	case journalBlock:
+		exist, err = s.backend.ReplayBlock(e.Login, e.Id, e.Params, e.Diff, e.RoundDiff, e.Height, e.Timestamp/1000, s.hashrateExpiration)
+	case journalSoloBlock:
+		exist, err = s.backend.WriteSoloBlock(e.Login, e.Id, e.Params, e.Diff, e.RoundDiff, e.Height, s.hashrateExpiration)
+	case journalPending:
+		if e.Pending == nil {
+			return nil
+		}
+		exist, err = s.backend.WritePendingShares(e.Pending)
+		if err != nil {
+			return err
+		}
+		if exist {
+			log.Printf("Journaled pending shares %s are already in backend", e.Pending.Id)
+		} else {
+			log.Printf("Inserted journaled pending shares %s to backend", e.Pending.Id)
+		}
+		return nil
+	default:
+		log.Printf("Unknown share journal entry %q", e.Kind)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if exist {
+		log.Printf("Journaled %s of %v at height %v is already in backend", e.Kind, e.Login, e.Height)
+	} else if e.Kind == journalBlock || e.Kind == journalSoloBlock {
+		log.Printf("Inserted journaled block %v to backend", e.Height)
+	}
+	return nil
+}
+
+type submitResult struct {
+	name string
+	ok   bool
+	err  error
+}
+
+/* Sends solution to all healthy upstreams at once, so a lagging or failing node
+ * does not cost us a block. Returns as soon as any node accepts it.
+ */
+func (s *ProxyServer) submitBlock(params []string, height uint64) (bool, error) {
+	current := s.rpc()
+	nodes := []*rpc.RPCClient{current}
+	for _, v := range s.upstreams {
+		if v != current && !v.Sick() {
+			nodes = append(nodes, v)
+		}
+	}
+
+	results := make(chan submitResult, len(nodes))
+	for _, v := range nodes {
+		go func(node *rpc.RPCClient) {
+			ok, err := node.SubmitBlock(params)
+			results <- submitResult{name: node.Name, ok: ok, err: err}
+		}(v)
+	}
+
+	rejected := false
+	var lastErr error
+	for i := range nodes {
+		r := <-results
+		r.log(height)
+		switch {
+		case r.err != nil:
+			lastErr = r.err
+		case !r.ok:
+			rejected = true
+		default:
+			// Let slower nodes report in background
+			go func(n int) {
+				for ; n > 0; n-- {
+					r := <-results
+					r.log(height)
+				}
+			}(len(nodes) - i - 1)
+			return true, nil
 		}
 	}
-	return false, true
+	if rejected {
+		return false, nil
+	}
+	return false, lastErr
+}
+
+func (r submitResult) log(height uint64) {
+	switch {
+	case r.err != nil:
+		log.Printf("Block submission to %s failed at height %v: %v", r.name, height, r.err)
+	case !r.ok:
+		log.Printf("Block rejected by %s at height %v", r.name, height)
+	default:
+		log.Printf("Block accepted by %s at height %v", r.name, height)
+	}
 }
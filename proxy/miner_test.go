@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/virbicoin/open-virbicoin-pool/rpc"
+)
+
+func testUpstream(t *testing.T, name string, accept bool) *rpc.RPCClient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":0,"result":%v}`, accept)
+	}))
+	t.Cleanup(srv.Close)
+	return rpc.NewRPCClient(name, srv.URL, "1s")
+}
+
+func TestSubmitBlockToAllUpstreams(t *testing.T) {
+	params := []string{"0x0", "0x0", "0x0"}
+	s := &ProxyServer{}
+	s.upstreams = []*rpc.RPCClient{testUpstream(t, "lagging", false), testUpstream(t, "synced", true)}
+	if ok, err := s.submitBlock(params, 1); !ok || err != nil {
+		t.Errorf("Block accepted by any upstream must count, got %v %v", ok, err)
+	}
+
+	s.upstreams = []*rpc.RPCClient{testUpstream(t, "main", false), rpc.NewRPCClient("down", "http://127.0.0.1:1", "1s")}
+	if ok, err := s.submitBlock(params, 1); ok || err != nil {
+		t.Errorf("Block rejected by upstream must be reported as rejected, got %v %v", ok, err)
+	}
+}
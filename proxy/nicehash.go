@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	protoUnknown = iota
+	protoEthProxy
+	protoEthStratum
+)
+
+const (
+	ethStratumVersion = "EthereumStratum/1.0.0"
+	extranonceSize    = 2 // In bytes, leaves 6 bytes of nonce space to a miner
+	maxExtranonce     = 1 << (extranonceSize * 8)
+	// Difficulty 1 in EthereumStratum/1.0.0 is 2^32
+	baseDiff = 4294967296.0
+)
+
+var zeroHash = common.Hash{}.Hex()
+
+func (cs *Session) handleEthStratumMessage(s *ProxyServer, req *StratumReq) error {
+	switch req.Method {
+	case "mining.subscribe":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		if len(params) > 1 && params[1] != ethStratumVersion {
+			errReply := &ErrorReply{Code: -1, Message: "Unsupported protocol version"}
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		reply, errReply := s.handleSubscribeRPC(cs)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
+	case "mining.extranonce.subscribe":
+		return cs.sendTCPResult(req.Id, true)
+	case "mining.authorize":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		if len(cs.extranonce) == 0 {
+			errReply := &ErrorReply{Code: 25, Message: "Not subscribed"}
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		if err := cs.sendTCPResult(req.Id, reply); err != nil {
+			return err
+		}
+		// Miner is idle until it gets a difficulty and a job
+		t := s.currentBlockTemplate()
+		if t == nil || len(t.Header) == 0 || s.isSick() {
+			return nil
+		}
+		return cs.pushNewJob(s, t)
+	case "mining.submit":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		reply, errReply := s.handleEthStratumSubmitRPC(cs, params)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
+	case "eth_submitHashrate":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		reply, errReply := s.handleSubmitHashrateRPC(cs, cs.login, cs.worker, params)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
+	default:
+		errReply := s.handleUnknownRPC(cs, req.Method)
+		return cs.sendTCPError(req.Id, errReply)
+	}
+}
+
+func (s *ProxyServer) handleSubscribeRPC(cs *Session) ([]interface{}, *ErrorReply) {
+	if len(cs.extranonce) == 0 {
+		extranonce, ok := s.allocExtranonce()
+		if !ok {
+			log.Printf("Extranonce space exhausted, rejecting %v", cs.ip)
+			return nil, &ErrorReply{Code: -1, Message: "Server is full"}
+		}
+		cs.extranonce = extranonce
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Failed to generate subscription id: %v", err)
+		return nil, &ErrorReply{Code: -1, Message: "Internal error"}
+	}
+	notify := []string{"mining.notify", hex.EncodeToString(id), ethStratumVersion}
+	return []interface{}{notify, cs.extranonce}, nil
+}
+
+// Params are [worker, jobId, nonce], nonce is lacking the extranonce prefix
+func (s *ProxyServer) handleEthStratumSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
+	s.sessionsMu.RLock()
+	_, ok := s.sessions[cs]
+	s.sessionsMu.RUnlock()
+
+	if !ok {
+		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+	}
+	if len(params) != 3 || len(cs.extranonce)+len(params[2]) != 16 {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed params from %s@%s %v", cs.login, cs.ip, params)
+		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
+	}
+
+	// Worker is bound at authorization, though a single connection may submit for several
+	_, id, _ := parseLogin(params[:1])
+	if len(id) == 0 {
+		id = cs.worker
+	}
+	nonce := "0x" + cs.extranonce + strings.ToLower(params[2])
+	header := "0x" + strings.ToLower(params[1])
+	// Mix digest is recovered along with verification once the job is known
+	return s.handleSubmitRPC(cs, cs.login, id, []string{nonce, header, zeroHash})
+}
+
+func (cs *Session) pushDifficulty(diff int64) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	message := JSONNotifyMessage{Method: "mining.set_difficulty", Params: []float64{float64(diff) / baseDiff}}
+	return cs.enc.Encode(&message)
+}
+
+// Difficulty is sent ahead of a job whenever it changes, it applies to the following jobs
+func (cs *Session) pushEthStratumJob(t *BlockTemplate) error {
+	diff, changed := cs.vardiff.jobDiff(t.Header)
+	if changed {
+		if err := cs.pushDifficulty(diff); err != nil {
+			return err
+		}
+	}
+	cs.Lock()
+	defer cs.Unlock()
+
+	params := []interface{}{
+		strings.TrimPrefix(t.Header, "0x"),
+		strings.TrimPrefix(t.Seed, "0x"),
+		strings.TrimPrefix(t.Header, "0x"),
+		true,
+	}
+	message := JSONNotifyMessage{Method: "mining.notify", Params: params}
+	return cs.enc.Encode(&message)
+}
+
+func (s *ProxyServer) allocExtranonce() (string, bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	for i := 0; i < maxExtranonce; i++ {
+		s.extranonceSeq = (s.extranonceSeq + 1) % maxExtranonce
+		extranonce := fmt.Sprintf("%0*x", extranonceSize*2, s.extranonceSeq)
+		if _, ok := s.extranonces[extranonce]; !ok {
+			s.extranonces[extranonce] = struct{}{}
+			return extranonce, true
+		}
+	}
+	return "", false
+}
@@ -21,6 +21,13 @@ type JSONPushMessage struct {
 	Result  interface{} `json:"result"`
 }
 
+// EthereumStratum/1.0.0
+type JSONNotifyMessage struct {
+	Id     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
 type JSONRpcResp struct {
 	Id      json.RawMessage `json:"id"`
 	Version string          `json:"jsonrpc"`
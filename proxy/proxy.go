@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -19,61 +20,152 @@ import (
 	"github.com/virbicoin/open-virbicoin-pool/util"
 )
 
+const httpMinerTTL = 10 * time.Minute
+
 type ProxyServer struct {
 	config             *Config
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
+	health             []*upstreamHealth
+	subscribed         []int32 // Per upstream, 1 while subscribed to its new heads
+	pendingRefreshIntv time.Duration
+	upstreamMaxLag     uint64
 	backend            *storage.RedisClient
-	diff               string
+	varDiff            *varDiffOptions
+	trustedProxies     []*net.IPNet
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	srv                *http.Server
+	quit               chan struct{}
+	longPollTimeout    time.Duration
+	staleWindow        int64
+	journal            *shareJournal
+	epochs             *epochTracker
+
+	// Closed and replaced on every new job to wake up long-polling HTTP miners
+	newJobMu sync.Mutex
+	newJob   chan struct{}
+
+	// Shares in flight hold read lock, so Stop can wait for them
+	shutdownMu sync.RWMutex
+	stopped    bool
+
+	// HTTP miners have no connection to keep difficulty state with
+	httpMinersMu sync.Mutex
+	httpMiners   map[string]*varDiff
 
 	// Stratum
-	sessionsMu sync.RWMutex
-	sessions   map[*Session]struct{}
-	timeout    time.Duration
+	sessionsMu    sync.RWMutex
+	sessions      map[*Session]string
+	loginSessions map[string]int
+	extranonces   map[string]struct{}
+	extranonceSeq int
+	listenersMu   sync.Mutex
+	listeners     []net.Listener
+	sessionSeq    uint64
+	ipConnsMu     sync.Mutex
+	ipConns       map[string]int
+	// Logins with sessions on last backend update, accessed only from state update loop
+	reportedLogins map[string]struct{}
 }
 
 type Session struct {
-	ip  string
-	enc *json.Encoder
+	ip      string
+	enc     *json.Encoder
+	vardiff *varDiff
 
 	// Stratum
 	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	conn        net.Conn
+	port        *stratumPort
+	login       string
+	worker      string
+	solo        bool
+	id          uint64
+	connectedAt int64
+	lastShare   int64
+	proto       int
+	extranonce  string
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
-	policy := policy.Start(&cfg.Proxy.Policy, backend)
-
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
-	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
+	policy := policy.Start(&cfg.Proxy.Policy, backend, cfg.Name)
+
+	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy, quit: make(chan struct{}), newJob: make(chan struct{})}
+	proxy.varDiff = newVarDiffOptions(&cfg.Proxy.VarDiff)
+	ethStratum := usesEthStratum(&cfg.Proxy.Stratum)
+	proxy.epochs = newEpochTracker(func(epoch uint64) { warmVerificationCache(epoch, ethStratum) })
+	proxy.httpMiners = make(map[string]*varDiff)
+	proxy.trustedProxies = parseTrustedProxies(cfg.Proxy.TrustedProxies)
+	if len(cfg.Proxy.StaleWindow) > 0 {
+		staleWindow := util.MustParseDuration(cfg.Proxy.StaleWindow)
+		proxy.staleWindow = int64(staleWindow / time.Millisecond)
+		log.Printf("Stale shares accepted within %v, credited: %v", staleWindow, cfg.Proxy.CreditStaleShares)
+	}
+	if len(cfg.Proxy.ShareJournal) > 0 {
+		proxy.journal = openShareJournal(cfg.Proxy.ShareJournal)
+		log.Printf("Using share journal %s", cfg.Proxy.ShareJournal)
+	}
+	if len(cfg.Proxy.ShareFlushInterval) > 0 {
+		backend.StartShareBatching(util.MustParseDuration(cfg.Proxy.ShareFlushInterval))
+	}
+	if len(cfg.Proxy.LongPollTimeout) > 0 {
+		proxy.longPollTimeout = util.MustParseDuration(cfg.Proxy.LongPollTimeout)
+		log.Printf("Long polling for HTTP miners enabled, timeout %v", proxy.longPollTimeout)
+	}
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+	proxy.subscribed = make([]int32, len(cfg.Upstream))
+	proxy.health = make([]*upstreamHealth, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
 		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
+		proxy.health[i] = &upstreamHealth{}
 		log.Printf("Upstream: %s => %s", v.Name, v.Url)
 	}
+	proxy.upstreamMaxLag = cfg.UpstreamMaxLag
+	if proxy.upstreamMaxLag == 0 {
+		proxy.upstreamMaxLag = defaultUpstreamMaxLag
+	}
 	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
 	if cfg.Proxy.Stratum.Enabled {
-		proxy.sessions = make(map[*Session]struct{})
-		go proxy.ListenTCP()
+		proxy.sessions = make(map[*Session]string)
+		proxy.loginSessions = make(map[string]int)
+		proxy.ipConns = make(map[string]int)
+		proxy.extranonces = make(map[string]struct{})
+		for _, port := range proxy.stratumPorts() {
+			go proxy.ListenTCP(port)
+		}
+	}
+	// Bans and lists are managed here even without stratum
+	if cfg.Proxy.Admin.Enabled {
+		go proxy.listenAdmin()
 	}
 
 	proxy.fetchBlockTemplate()
 
-	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
-
 	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set block refresh every %v", refreshIntv)
+	subscribedRefreshIntv := refreshIntv
+	if len(cfg.Proxy.SubscribedRefreshInterval) > 0 {
+		subscribedRefreshIntv = util.MustParseDuration(cfg.Proxy.SubscribedRefreshInterval)
+	}
+	proxy.pendingRefreshIntv = subscribedRefreshIntv
+
+	headsCtx, cancelHeads := context.WithCancel(context.Background())
+	for i, v := range cfg.Upstream {
+		if len(v.WsUrl) > 0 {
+			go proxy.watchNewHeads(headsCtx, i, v.WsUrl)
+		}
+	}
+
+	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
 	checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
@@ -82,21 +174,45 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
 	go func() {
-		for range refreshTimer.C {
-			proxy.fetchBlockTemplate()
-			refreshTimer.Reset(refreshIntv)
+		lastPoll := time.Now()
+		for {
+			select {
+			case <-proxy.quit:
+				refreshTimer.Stop()
+				cancelHeads()
+				return
+			case <-refreshTimer.C:
+				// New blocks come from subscription of active upstream, polling only picks up new transactions
+				if !proxy.headsSubscribed() || time.Since(lastPoll) >= subscribedRefreshIntv {
+					proxy.fetchBlockTemplate()
+					lastPoll = time.Now()
+				}
+				refreshTimer.Reset(refreshIntv)
+			}
 		}
 	}()
 
 	go func() {
-		for range checkTimer.C {
-			proxy.checkUpstreams()
-			checkTimer.Reset(checkIntv)
+		for {
+			select {
+			case <-proxy.quit:
+				checkTimer.Stop()
+				return
+			case <-checkTimer.C:
+				proxy.checkUpstreams()
+				checkTimer.Reset(checkIntv)
+			}
 		}
 	}()
 
 	go func() {
-		for range stateUpdateTimer.C {
+		for {
+			select {
+			case <-proxy.quit:
+				stateUpdateTimer.Stop()
+				return
+			case <-stateUpdateTimer.C:
+			}
 			t := proxy.currentBlockTemplate()
 			if t != nil {
 				err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
@@ -105,8 +221,19 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 					proxy.markSick()
 				} else {
 					proxy.markOk()
+					epoch, next, cache := proxy.epochs.state()
+					if err := backend.WriteNodeEpoch(cfg.Name, epoch, next, cache); err != nil {
+						log.Printf("Failed to write node epoch to backend: %v", err)
+					}
+					if proxy.journal != nil {
+						proxy.replayJournal()
+					}
 				}
 			}
+			proxy.purgeHttpMiners()
+			if cfg.Proxy.Stratum.Enabled {
+				proxy.writeSessionCounts(stateUpdateIntv * 3)
+			}
 			stateUpdateTimer.Reset(stateUpdateIntv)
 		}
 	}()
@@ -117,39 +244,101 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 func (s *ProxyServer) Start() {
 	log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
 	r := mux.NewRouter()
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,8}}", s)
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}", s)
+	r.Handle("/{login:0x[0-9a-fA-F]{40}(?:\\+solo)?}/{id:[0-9a-zA-Z-_]{1,8}}", s)
+	r.Handle("/{login:0x[0-9a-fA-F]{40}(?:\\+solo)?}", s)
 	srv := &http.Server{
 		Addr:           s.config.Proxy.Listen,
 		Handler:        r,
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, &httpConn{})
+		},
+	}
+	s.listenersMu.Lock()
+	s.srv = srv
+	s.listenersMu.Unlock()
+	select {
+	case <-s.quit:
+		return
+	default:
 	}
-	err := srv.ListenAndServe()
+
+	ln, err := net.Listen("tcp", s.config.Proxy.Listen)
 	if err != nil {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
+	if s.config.Proxy.ProxyProtocol {
+		if len(s.trustedProxies) == 0 {
+			log.Fatal("PROXY protocol requires trustedProxies to be set")
+		}
+		ln = &proxyListener{Listener: ln, trusted: s.isTrustedProxy}
+	}
+	err = srv.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
 }
 
-func (s *ProxyServer) rpc() *rpc.RPCClient {
-	i := atomic.LoadInt32(&s.upstream)
-	return s.upstreams[i]
-}
+/* Stops accepting miners, lets shares in flight reach redis and only then
+ * drops stratum sessions, so no submitted share is lost on restart.
+ */
+func (s *ProxyServer) Stop(ctx context.Context) error {
+	log.Println("Stopping proxy")
+	close(s.quit)
 
-func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
+	s.listenersMu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	srv := s.srv
+	s.listenersMu.Unlock()
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
 
-	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
+	s.shutdownMu.Lock()
+	s.stopped = true
+	s.shutdownMu.Unlock()
+	if pending, err := s.backend.StopShareBatching(ctx); pending != nil {
+		if s.journal != nil {
+			log.Printf("Keeping pending shares in share journal: %v", err)
+			s.journalShare(&journalEntry{Kind: journalPending, Pending: pending})
+		} else {
+			log.Printf("Pending shares are lost, share journal is disabled: %v", err)
 		}
 	}
+	if s.journal != nil {
+		s.journal.close()
+	}
+
+	s.sessionsMu.RLock()
+	log.Printf("Closing %v stratum sessions", len(s.sessions))
+	for cs := range s.sessions {
+		cs.conn.Close()
+	}
+	s.sessionsMu.RUnlock()
+	return err
+}
 
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+// Returns false once proxy is stopping, call endShare after share is processed
+func (s *ProxyServer) beginShare() bool {
+	s.shutdownMu.RLock()
+	if s.stopped {
+		s.shutdownMu.RUnlock()
+		return false
 	}
+	return true
+}
+
+func (s *ProxyServer) endShare() {
+	s.shutdownMu.RUnlock()
+}
+
+func (s *ProxyServer) rpc() *rpc.RPCClient {
+	i := atomic.LoadInt32(&s.upstream)
+	return s.upstreams[i]
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -164,13 +353,26 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ProxyServer) remoteAddr(r *http.Request) string {
-	if s.config.Proxy.BehindReverseProxy {
-		ip := r.Header.Get("X-Forwarded-For")
-		if len(ip) > 0 && net.ParseIP(ip) != nil {
-			return ip
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !s.config.Proxy.BehindReverseProxy {
+		return ip
+	}
+	// Without a list of trusted proxies we trust only the peer we are connected to
+	if len(s.trustedProxies) > 0 && !s.isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+	// Walk the chain from the nearest hop and stop at the first address that is not ours
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !s.isTrustedProxy(hop) {
+			break
 		}
 	}
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
 	return ip
 }
 
@@ -184,7 +386,8 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
 	defer r.Body.Close()
 
-	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
+	vars := mux.Vars(r)
+	cs := &Session{ip: ip, enc: json.NewEncoder(w), vardiff: s.httpVarDiff(vars["login"], vars["id"], ip)}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var req JSONRpcReq
@@ -199,6 +402,92 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	}
 }
 
+func (s *ProxyServer) httpVarDiff(login, id, ip string) *varDiff {
+	key := strings.ToLower(login) + ":" + id + ":" + ip
+	s.httpMinersMu.Lock()
+	defer s.httpMinersMu.Unlock()
+
+	v, ok := s.httpMiners[key]
+	if !ok {
+		v = newVarDiff(s.config.Proxy.Difficulty, s.varDiff)
+		s.httpMiners[key] = v
+	}
+	return v
+}
+
+func (s *ProxyServer) newJobSignal() <-chan struct{} {
+	s.newJobMu.Lock()
+	defer s.newJobMu.Unlock()
+	return s.newJob
+}
+
+func (s *ProxyServer) signalNewJob() {
+	s.newJobMu.Lock()
+	defer s.newJobMu.Unlock()
+	close(s.newJob)
+	s.newJob = make(chan struct{})
+}
+
+type httpConnKey struct{}
+
+/* Job last sent over a keep-alive HTTP connection. Rigs behind one address
+ * with the same or no worker id share vardiff, but each has its own connection.
+ */
+type httpConn struct {
+	sync.Mutex
+	job string
+}
+
+func httpConnOf(r *http.Request) *httpConn {
+	c, _ := r.Context().Value(httpConnKey{}).(*httpConn)
+	return c
+}
+
+func (c *httpConn) lastJob() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.job
+}
+
+func (c *httpConn) setJob(header string) {
+	c.Lock()
+	defer c.Unlock()
+	c.job = header
+}
+
+// Blocks while connection already got current job, until a new one appears, timeout or disconnect
+func (s *ProxyServer) waitForNewJob(r *http.Request) {
+	// Subscribe before checking template to not miss an update in between
+	signal := s.newJobSignal()
+	t := s.currentBlockTemplate()
+	c := httpConnOf(r)
+	if t == nil || c == nil || c.lastJob() != t.Header {
+		return
+	}
+	timer := time.NewTimer(s.longPollTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-signal:
+	case <-timer.C:
+	case <-r.Context().Done():
+	case <-s.quit:
+	}
+}
+
+func (s *ProxyServer) purgeHttpMiners() {
+	now := util.MakeTimestamp()
+	ttl := int64(httpMinerTTL / time.Millisecond)
+	s.httpMinersMu.Lock()
+	defer s.httpMinersMu.Unlock()
+
+	for key, v := range s.httpMiners {
+		if v.idle(now, ttl) {
+			delete(s.httpMiners, key)
+		}
+	}
+}
+
 func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcReq) {
 	if req.Id == nil {
 		log.Printf("Missing RPC id from %s", cs.ip)
@@ -207,7 +496,8 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	}
 
 	vars := mux.Vars(r)
-	login := strings.ToLower(vars["login"])
+	login, solo := s.parseSolo(strings.ToLower(vars["login"]))
+	cs.solo = solo
 
 	if !util.IsValidHexAddress(login) {
 		errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
@@ -227,6 +517,9 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	// Handle RPC methods
 	switch req.Method {
 	case "eth_getWork":
+		if s.longPollTimeout > 0 {
+			s.waitForNewJob(r)
+		}
 		reply, errReply := s.handleGetWorkRPC(cs)
 		if errReply != nil {
 			if err := cs.sendError(req.Id, errReply); err != nil {
@@ -236,6 +529,8 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 		}
 		if err := cs.sendResult(req.Id, &reply); err != nil {
 			log.Printf("Failed to send result: %v", err)
+		} else if c := httpConnOf(r); c != nil {
+			c.setJob(reply[0])
 		}
 	case "eth_submitWork":
 		if req.Params != nil {
@@ -269,7 +564,20 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 			log.Printf("Failed to send result: %v", err)
 		}
 	case "eth_submitHashrate":
-		if err := cs.sendResult(req.Id, true); err != nil {
+		var params []string
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			log.Printf("Unable to parse params from %v", cs.ip)
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			break
+		}
+		reply, errReply := s.handleSubmitHashrateRPC(cs, login, vars["id"], params)
+		if errReply != nil {
+			if err := cs.sendError(req.Id, errReply); err != nil {
+				log.Printf("Failed to send error response: %v", err)
+			}
+			break
+		}
+		if err := cs.sendResult(req.Id, reply); err != nil {
 			log.Printf("Failed to send result: %v", err)
 		}
 	default:
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLongPollWakesOnNewJob(t *testing.T) {
+	s := &ProxyServer{quit: make(chan struct{}), newJob: make(chan struct{}), longPollTimeout: time.Minute}
+	s.blockTemplate.Store(&BlockTemplate{Header: "0x1"})
+	c := &httpConn{}
+	r, _ := http.NewRequest("POST", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), httpConnKey{}, c))
+
+	// Miner without a job is answered immediately
+	start := time.Now()
+	s.waitForNewJob(r)
+	if time.Since(start) > time.Second {
+		t.Fatal("Miner without current job must not wait")
+	}
+	c.setJob("0x1")
+
+	// Another rig of the same login, id and address has a connection of its own
+	other, _ := http.NewRequest("POST", "/", nil)
+	other = other.WithContext(context.WithValue(other.Context(), httpConnKey{}, &httpConn{}))
+	start = time.Now()
+	s.waitForNewJob(other)
+	if time.Since(start) > time.Second {
+		t.Fatal("Connection without current job must not wait")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.waitForNewJob(r)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Miner with current job must wait for a new one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.blockTemplate.Store(&BlockTemplate{Header: "0x2"})
+	s.signalNewJob()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("New job must wake up waiting miner")
+	}
+}
+
+func TestHeadsSubscribedFollowsActiveUpstream(t *testing.T) {
+	s := &ProxyServer{subscribed: make([]int32, 2)}
+	s.subscribed[1] = 1
+	if s.headsSubscribed() {
+		t.Error("Subscription of backup upstream must not relax polling")
+	}
+	s.upstream = 1
+	if !s.headsSubscribed() {
+		t.Error("Subscription of active upstream must relax polling")
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAProxy PROXY protocol, https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+	proxyHeaderWait  = 5 * time.Second
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/* Connection accepted from a trusted load balancer. Header is parsed lazily on the
+ * first Read or RemoteAddr call, so it never blocks an accept loop. Connections
+ * without a header are passed through as is.
+ */
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderWait)); err != nil {
+			c.err = err
+			return
+		}
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			log.Printf("Malformed PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+		}
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = err
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Wraps connections coming from trusted proxies
+type proxyListener struct {
+	net.Listener
+	trusted func(net.IP) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	if l.trusted(addrIP(conn.RemoteAddr())) {
+		return newProxyConn(conn), nil
+	}
+	return conn, nil
+}
+
+// Returns source address from a header, nil if there is no header or it's a LOCAL one
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil && !bytes.HasPrefix(proxyV2Signature, sig) && !strings.HasPrefix(proxyV1Prefix, string(sig)) {
+		// Too short for a header, but a regular request can be that short
+		return nil, nil
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if len(sig) >= len(proxyV1Prefix) && string(sig[:len(proxyV1Prefix)]) == proxyV1Prefix {
+		return readProxyHeaderV1(r)
+	}
+	return nil, err
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, connection is made by a proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, errors.New("v2 header is too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, errors.New("v2 header is too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	// AF_UNSPEC and AF_UNIX carry nothing useful for banning
+	return nil, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, _ := net.SplitHostPort(addr.String())
+		return net.ParseIP(host)
+	}
+}
+
+// Accepts both CIDRs and bare addresses
+func parseTrustedProxies(list []string) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				log.Fatalf("Invalid trusted proxy address: %s", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("Invalid trusted proxy network %s: %v", v, err)
+		}
+		result = append(result, ipnet)
+	}
+	return result
+}
+
+func (s *ProxyServer) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range s.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
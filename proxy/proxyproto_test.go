@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8008\r\n{\"id\":1}\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("Failed to parse v1 header: %v", err)
+	}
+	if addr.String() != "203.0.113.7:51234" {
+		t.Errorf("Wrong source address %v", addr)
+	}
+	if rest, _ := r.ReadString('\n'); rest != "{\"id\":1}\n" {
+		t.Errorf("Payload must follow the header, got %q", rest)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x21})
+	binary.Write(&buf, binary.BigEndian, uint16(36+3))
+	buf.Write(net.ParseIP("2001:db8::1"))
+	buf.Write(net.ParseIP("2001:db8::2"))
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(8008))
+	// Empty TLV must be skipped
+	buf.Write([]byte{0x04, 0x00, 0x00})
+	buf.WriteString("{\"id\":1}\n")
+
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("Failed to parse v2 header: %v", err)
+	}
+	if addr.String() != "[2001:db8::1]:40000" {
+		t.Errorf("Wrong source address %v", addr)
+	}
+	if rest, _ := r.ReadString('\n'); rest != "{\"id\":1}\n" {
+		t.Errorf("Payload must follow the header, got %q", rest)
+	}
+}
+
+func TestReadProxyHeaderAbsent(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("{\"id\":1,\"method\":\"eth_submitLogin\"}\n"))
+	addr, err := readProxyHeader(r)
+	if addr != nil || err != nil {
+		t.Errorf("Connection without header must pass through, got %v %v", addr, err)
+	}
+	if rest, _ := r.ReadString('\n'); !strings.HasPrefix(rest, "{\"id\":1") {
+		t.Errorf("Request must not be consumed, got %q", rest)
+	}
+}
+
+func TestRemoteAddrForwardedChain(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	s.config.Proxy.BehindReverseProxy = true
+	s.trustedProxies = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+
+	r := &http.Request{RemoteAddr: "10.0.0.5:1234", Header: http.Header{}}
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 198.51.100.4")
+	r.Header.Add("X-Forwarded-For", "192.0.2.1")
+	if ip := s.remoteAddr(r); ip != "198.51.100.4" {
+		t.Errorf("Expected first untrusted hop, got %v", ip)
+	}
+
+	r.RemoteAddr = "198.51.100.9:1234"
+	if ip := s.remoteAddr(r); ip != "198.51.100.9" {
+		t.Errorf("Header from untrusted peer must be ignored, got %v", ip)
+	}
+}
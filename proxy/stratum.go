@@ -2,11 +2,14 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/virbicoin/open-virbicoin-pool/util"
@@ -16,11 +19,70 @@ const (
 	MaxReqSize = 1024
 )
 
-func (s *ProxyServer) ListenTCP() {
-	timeout := util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
-	s.timeout = timeout
+type stratumPort struct {
+	name          string
+	listen        string
+	diff          int64
+	varDiff       *varDiffOptions
+	timeout       time.Duration
+	maxConn       int
+	proto         int
+	tls           *tlsLoader
+	proxyProtocol bool
+	solo          bool
+}
+
+// Falls back to a single port described by legacy stratum options
+func (s *ProxyServer) stratumPorts() []*stratumPort {
+	cfg := &s.config.Proxy.Stratum
+	ports := cfg.Ports
+	if len(ports) == 0 {
+		ports = []StratumPort{{Name: "default", Listen: cfg.Listen, VarDiff: s.varDiff != nil}}
+	}
 
-	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratum.Listen)
+	result := make([]*stratumPort, len(ports))
+	for i, v := range ports {
+		port := &stratumPort{name: v.Name, listen: v.Listen, diff: v.Difficulty, maxConn: v.MaxConn, proxyProtocol: v.ProxyProtocol, solo: v.Solo}
+		if port.diff == 0 {
+			port.diff = s.config.Proxy.Difficulty
+		}
+		if port.maxConn == 0 {
+			port.maxConn = cfg.MaxConn
+		}
+		timeout := v.Timeout
+		if len(timeout) == 0 {
+			timeout = cfg.Timeout
+		}
+		port.timeout = util.MustParseDuration(timeout)
+		if v.VarDiff {
+			if s.varDiff == nil {
+				log.Fatalf("Stratum port %s requires varDiff to be enabled", v.Listen)
+			}
+			port.varDiff = s.varDiff
+		}
+		switch strings.ToLower(v.Protocol) {
+		case "":
+			port.proto = protoUnknown
+		case "stratum", "ethproxy":
+			port.proto = protoEthProxy
+		case "ethstratum", "nicehash":
+			port.proto = protoEthStratum
+		default:
+			log.Fatalf("Unknown protocol %s on stratum port %s", v.Protocol, v.Listen)
+		}
+		if v.TLS {
+			port.tls = newTLSLoader(&ports[i], s.quit)
+		}
+		if v.ProxyProtocol && len(s.trustedProxies) == 0 {
+			log.Fatalf("PROXY protocol on stratum port %s requires trustedProxies to be set", v.Listen)
+		}
+		result[i] = port
+	}
+	return result
+}
+
+func (s *ProxyServer) ListenTCP(port *stratumPort) {
+	addr, err := net.ResolveTCPAddr("tcp", port.listen)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
@@ -29,51 +91,85 @@ func (s *ProxyServer) ListenTCP() {
 		log.Fatalf("Error: %v", err)
 	}
 	defer server.Close()
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, server)
+	s.listenersMu.Unlock()
+	select {
+	case <-s.quit:
+		return
+	default:
+	}
+
+	var tlsConfig *tls.Config
+	if port.tls != nil {
+		tlsConfig = port.tls.serverConfig()
+	}
 
-	log.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
+	log.Printf("Stratum listening on %s (%s), difficulty %v, vardiff %v, tls %v, proxy protocol %v",
+		port.listen, port.name, port.diff, port.varDiff != nil, port.tls != nil, port.proxyProtocol)
+	var accept = make(chan int, port.maxConn)
 	n := 0
 
 	for {
 		conn, err := server.AcceptTCP()
 		if err != nil {
-			continue
+			select {
+			case <-s.quit:
+				return
+			default:
+				continue
+			}
 		}
 		if err := conn.SetKeepAlive(true); err != nil {
 			log.Printf("Failed to set keep alive: %v", err)
 		}
-
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-
-		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
-			conn.Close()
-			continue
-		}
 		n += 1
-		cs := &Session{conn: conn, ip: ip}
+		var c net.Conn = conn
+		// PROXY header goes ahead of TLS handshake
+		if port.proxyProtocol && s.isTrustedProxy(addrIP(conn.RemoteAddr())) {
+			c = newProxyConn(conn)
+		}
+		if tlsConfig != nil {
+			c = tls.Server(c, tlsConfig)
+		}
 
 		accept <- n
-		go func(cs *Session) {
-			err = s.handleTCPClient(cs)
+		go func(c net.Conn) {
+			defer func() { <-accept }()
+			// Reads PROXY header if any, so it's done out of accept loop
+			ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+				c.Close()
+				return
+			}
+			if !s.acquireConn(ip) {
+				log.Printf("Too many connections from %v", ip)
+				rejectConn(c, &ErrorReply{Code: -1, Message: "Too many connections from your IP"})
+				return
+			}
+			defer s.releaseConn(ip)
+			cs := &Session{conn: c, ip: ip, port: port, proto: port.proto, vardiff: newVarDiff(port.diff, port.varDiff)}
+			cs.id = atomic.AddUint64(&s.sessionSeq, 1)
+			cs.connectedAt = util.MakeTimestamp()
+			err := s.handleTCPClient(cs)
 			if err != nil {
 				s.removeSession(cs)
-				conn.Close()
+				cs.conn.Close()
 			}
-			<-accept
-		}(cs)
+		}(c)
 	}
 }
 
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
-	s.setDeadline(cs.conn)
+	cs.setDeadline()
 
 	for {
 		data, isPrefix, err := connbuff.ReadLine()
 		if isPrefix {
 			log.Printf("Socket flood detected from %s", cs.ip)
-			s.policy.BanClient(cs.ip)
+			s.policy.BanClient(cs.ip, "socket flood")
 			return err
 		} else if err == io.EOF {
 			log.Printf("Client %s disconnected", cs.ip)
@@ -92,7 +188,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 				log.Printf("Malformed stratum request from %s: %v", cs.ip, err)
 				return err
 			}
-			s.setDeadline(cs.conn)
+			cs.setDeadline()
 			err = cs.handleTCPMessage(s, &req)
 			if err != nil {
 				return err
@@ -103,6 +199,18 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 }
 
 func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
+	// Dialect is detected by the first request on a connection
+	if cs.proto == protoUnknown {
+		if req.Method == "mining.subscribe" {
+			cs.proto = protoEthStratum
+		} else {
+			cs.proto = protoEthProxy
+		}
+	}
+	if cs.proto == protoEthStratum {
+		return cs.handleEthStratumMessage(s, req)
+	}
+
 	// Handle RPC methods
 	switch req.Method {
 	case "eth_submitLogin":
@@ -136,7 +244,21 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		}
 		return cs.sendTCPResult(req.Id, &reply)
 	case "eth_submitHashrate":
-		return cs.sendTCPResult(req.Id, true)
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		id := req.Worker
+		if len(id) == 0 {
+			id = cs.worker
+		}
+		reply, errReply := s.handleSubmitHashrateRPC(cs, cs.login, id, params)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		return cs.sendTCPError(req.Id, errReply)
@@ -151,11 +273,17 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
 	return cs.enc.Encode(&message)
 }
 
-func (cs *Session) pushNewJob(result interface{}) error {
+func (cs *Session) pushNewJob(s *ProxyServer, t *BlockTemplate) error {
+	if cs.proto == protoEthStratum {
+		return cs.pushEthStratumJob(t)
+	}
+	diff, _ := cs.vardiff.jobDiff(t.Header)
+	reply := []string{t.Header, t.Seed, util.GetTargetHex(diff)}
+
 	cs.Lock()
 	defer cs.Unlock()
 	// FIXME: Temporarily add ID for Claymore compliance
-	message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
+	message := JSONPushMessage{Version: "2.0", Result: &reply, Id: 0}
 	return cs.enc.Encode(&message)
 }
 
@@ -171,22 +299,109 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
 	return errors.New(reply.Message)
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn) {
-	if err := conn.SetDeadline(time.Now().Add(self.timeout)); err != nil {
+func (cs *Session) setDeadline() {
+	if err := cs.conn.SetDeadline(time.Now().Add(cs.port.timeout)); err != nil {
 		log.Printf("Failed to set deadline: %v", err)
 	}
 }
 
-func (s *ProxyServer) registerSession(cs *Session) {
+// Tells miner why it is dropped, there is no request to reply to yet
+func rejectConn(c net.Conn, reply *ErrorReply) {
+	if err := c.SetWriteDeadline(time.Now().Add(5 * time.Second)); err == nil {
+		message := JSONRpcResp{Id: json.RawMessage("0"), Version: "2.0", Error: reply}
+		json.NewEncoder(c).Encode(&message)
+	}
+	c.Close()
+}
+
+func (s *ProxyServer) exemptFromCaps(ip string) bool {
+	return s.policy != nil && s.policy.InWhiteList(ip)
+}
+
+func (s *ProxyServer) acquireConn(ip string) bool {
+	s.ipConnsMu.Lock()
+	defer s.ipConnsMu.Unlock()
+	max := s.config.Proxy.Stratum.MaxConnPerIP
+	if max > 0 && s.ipConns[ip] >= max && !s.exemptFromCaps(ip) {
+		return false
+	}
+	s.ipConns[ip]++
+	return true
+}
+
+func (s *ProxyServer) releaseConn(ip string) {
+	s.ipConnsMu.Lock()
+	defer s.ipConnsMu.Unlock()
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+/* Returns false if login already has as many sessions as allowed. Miner identity
+ * is set under lock since admin API reads it from other goroutines.
+ */
+func (s *ProxyServer) registerSession(cs *Session, login, worker string, solo bool) bool {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
-	s.sessions[cs] = struct{}{}
+	old, ok := s.sessions[cs]
+	if !ok || old != login {
+		max := s.config.Proxy.Stratum.MaxSessionsPerLogin
+		if max > 0 && s.loginSessions[login] >= max && !s.exemptFromCaps(cs.ip) {
+			return false
+		}
+		if ok {
+			s.releaseLogin(old)
+		}
+		s.sessions[cs] = login
+		s.loginSessions[login]++
+	}
+	cs.login = login
+	cs.worker = worker
+	cs.solo = solo
+	return true
 }
 
 func (s *ProxyServer) removeSession(cs *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
+	if login, ok := s.sessions[cs]; ok {
+		s.releaseLogin(login)
+	}
 	delete(s.sessions, cs)
+	if len(cs.extranonce) > 0 {
+		delete(s.extranonces, cs.extranonce)
+	}
+}
+
+func (s *ProxyServer) releaseLogin(login string) {
+	if s.loginSessions[login]--; s.loginSessions[login] <= 0 {
+		delete(s.loginSessions, login)
+	}
+}
+
+// Logins gone since last update are written with zero count to remove them
+func (s *ProxyServer) writeSessionCounts(expire time.Duration) {
+	counts := make(map[string]int)
+	s.sessionsMu.RLock()
+	for login, n := range s.loginSessions {
+		counts[login] = n
+	}
+	s.sessionsMu.RUnlock()
+
+	reported := make(map[string]struct{}, len(counts))
+	for login := range counts {
+		reported[login] = struct{}{}
+	}
+	for login := range s.reportedLogins {
+		if _, ok := counts[login]; !ok {
+			counts[login] = 0
+		}
+	}
+	if err := s.backend.WriteSessionCounts(s.config.Name, counts, expire); err != nil {
+		log.Printf("Failed to write session counts to backend: %v", err)
+		return
+	}
+	s.reportedLogins = reported
 }
 
 func (s *ProxyServer) broadcastNewJobs() {
@@ -194,7 +409,6 @@ func (s *ProxyServer) broadcastNewJobs() {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return
 	}
-	reply := []string{t.Header, t.Seed, s.diff}
 
 	s.sessionsMu.RLock()
 	defer s.sessionsMu.RUnlock()
@@ -211,13 +425,13 @@ func (s *ProxyServer) broadcastNewJobs() {
 		bcast <- n
 
 		go func(cs *Session) {
-			err := cs.pushNewJob(&reply)
+			err := cs.pushNewJob(s, t)
 			<-bcast
 			if err != nil {
 				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
 				s.removeSession(cs)
 			} else {
-				s.setDeadline(cs.conn)
+				cs.setDeadline()
 			}
 		}(m)
 	}
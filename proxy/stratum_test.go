@@ -0,0 +1,38 @@
+package proxy
+
+import "testing"
+
+func TestSessionCaps(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	s.config.Proxy.Stratum.MaxConnPerIP = 2
+	s.config.Proxy.Stratum.MaxSessionsPerLogin = 1
+	s.sessions = make(map[*Session]string)
+	s.loginSessions = make(map[string]int)
+	s.ipConns = make(map[string]int)
+
+	if !s.acquireConn("10.0.0.1") || !s.acquireConn("10.0.0.1") {
+		t.Fatal("Connections within cap must be accepted")
+	}
+	if s.acquireConn("10.0.0.1") {
+		t.Error("Connection over per IP cap must be rejected")
+	}
+	s.releaseConn("10.0.0.1")
+	if !s.acquireConn("10.0.0.1") {
+		t.Error("Released connection must free a slot")
+	}
+
+	a, b := &Session{ip: "10.0.0.1"}, &Session{ip: "10.0.0.2"}
+	if !s.registerSession(a, "0x1", "rig1", false) || !s.registerSession(a, "0x1", "rig1", false) {
+		t.Fatal("Session within cap must be registered")
+	}
+	if s.registerSession(b, "0x1", "rig2", false) {
+		t.Error("Session over per login cap must be rejected")
+	}
+	s.removeSession(a)
+	if !s.registerSession(b, "0x1", "rig2", false) {
+		t.Error("Removed session must free a slot")
+	}
+	if len(s.loginSessions) != 1 || s.loginSessions["0x1"] != 1 {
+		t.Errorf("Wrong session counts %v", s.loginSessions)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = time.Minute
+
+// Keeps TLS settings of a stratum port, certificates are reloaded once files change on disk
+type tlsLoader struct {
+	sync.RWMutex
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	config       *tls.Config
+	modTime      time.Time
+}
+
+// Reloading stops once quit is closed
+func newTLSLoader(port *StratumPort, quit <-chan struct{}) *tlsLoader {
+	if len(port.CertFile) == 0 || len(port.KeyFile) == 0 {
+		log.Fatalf("TLS stratum port %s requires certFile and keyFile", port.Listen)
+	}
+	l := &tlsLoader{certFile: port.CertFile, keyFile: port.KeyFile, clientCAFile: port.ClientCAFile}
+	switch {
+	case port.RequireClientCert && len(port.ClientCAFile) > 0:
+		l.clientAuth = tls.RequireAndVerifyClientCert
+	case port.RequireClientCert:
+		l.clientAuth = tls.RequireAnyClientCert
+	case len(port.ClientCAFile) > 0:
+		l.clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		l.clientAuth = tls.NoClientCert
+	}
+	if _, err := l.reload(); err != nil {
+		log.Fatalf("Failed to load TLS certificate for stratum port %s: %v", port.Listen, err)
+	}
+
+	go func() {
+		timer := time.NewTimer(certReloadInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-timer.C:
+			}
+			reloaded, err := l.reload()
+			if err != nil {
+				log.Printf("Failed to reload TLS certificate %s, keeping previous one: %v", l.certFile, err)
+			} else if reloaded {
+				log.Printf("Reloaded TLS certificate %s", l.certFile)
+			}
+			timer.Reset(certReloadInterval)
+		}
+	}()
+	return l
+}
+
+// Returns config for every new connection so that reloaded certificates are picked up
+func (l *tlsLoader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l.RLock()
+			defer l.RUnlock()
+			return l.config, nil
+		},
+	}
+}
+
+func (l *tlsLoader) reload() (bool, error) {
+	modTime, err := l.lastModified()
+	if err != nil {
+		return false, err
+	}
+	l.RLock()
+	fresh := l.config != nil && !modTime.After(l.modTime)
+	l.RUnlock()
+	if fresh {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return false, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   l.clientAuth,
+	}
+	if len(l.clientCAFile) > 0 {
+		pem, err := os.ReadFile(l.clientCAFile)
+		if err != nil {
+			return false, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, errors.New("no certificates found in " + l.clientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	l.Lock()
+	l.config = config
+	l.modTime = modTime
+	l.Unlock()
+	return true, nil
+}
+
+func (l *tlsLoader) lastModified() (time.Time, error) {
+	var result time.Time
+	for _, name := range []string{l.certFile, l.keyFile, l.clientCAFile} {
+		if len(name) == 0 {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return result, err
+		}
+		if info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return result, nil
+}
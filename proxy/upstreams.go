@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/virbicoin/open-virbicoin-pool/rpc"
+	"github.com/virbicoin/open-virbicoin-pool/storage"
+)
+
+const (
+	// Number of recent checks error rate is computed from
+	upstreamHistory = 20
+	// Blocks a node may fall behind the best one, new block rarely reaches all nodes at once
+	defaultUpstreamMaxLag = 2
+	// Healthy active node is replaced only by a much better one to avoid flapping
+	upstreamSwitchRatio = 0.5
+)
+
+// Accessed only from upstream check loop
+type upstreamHealth struct {
+	healthy bool
+	height  uint64
+	latency time.Duration
+	results [upstreamHistory]bool
+	checks  int
+}
+
+func (h *upstreamHealth) record(ok bool, height uint64, latency time.Duration) {
+	h.results[h.checks%upstreamHistory] = ok
+	h.checks++
+	h.healthy = ok
+	if !ok {
+		return
+	}
+	h.height = height
+	// Smooth latency so a single slow reply does not cause a switch
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = (h.latency*7 + latency*3) / 10
+	}
+}
+
+func (h *upstreamHealth) errorRate() float64 {
+	n := h.checks
+	if n > upstreamHistory {
+		n = upstreamHistory
+	}
+	if n == 0 {
+		return 0
+	}
+	failed := 0
+	for _, ok := range h.results[:n] {
+		if !ok {
+			failed++
+		}
+	}
+	return float64(failed) / float64(n)
+}
+
+// Lower is better
+func (h *upstreamHealth) score() float64 {
+	return float64(h.latency/time.Millisecond+1) * (1 + 10*h.errorRate())
+}
+
+/* Picks node to get work from. Nodes falling behind the best known height are not
+ * eligible, among the rest the fastest and most reliable wins. Returns current node
+ * and empty reason if there is nothing better.
+ */
+func selectUpstream(current int, health []*upstreamHealth, maxLag uint64) (int, string) {
+	var best uint64
+	for _, h := range health {
+		if h.healthy && h.height > best {
+			best = h.height
+		}
+	}
+	eligible := func(h *upstreamHealth) bool {
+		return h.healthy && h.height+maxLag >= best
+	}
+
+	candidate := -1
+	for i, h := range health {
+		if eligible(h) && (candidate < 0 || h.score() < health[candidate].score()) {
+			candidate = i
+		}
+	}
+	if candidate < 0 || candidate == current {
+		return current, ""
+	}
+
+	h := health[current]
+	switch {
+	case !h.healthy:
+		return candidate, "unhealthy"
+	case !eligible(h):
+		return candidate, fmt.Sprintf("%v blocks behind", best-h.height)
+	case health[candidate].score() < h.score()*upstreamSwitchRatio:
+		c := health[candidate]
+		return candidate, fmt.Sprintf("slow, latency %v vs %v, error rate %.0f%% vs %.0f%%",
+			h.latency, c.latency, h.errorRate()*100, c.errorRate()*100)
+	}
+	return current, ""
+}
+
+func (s *ProxyServer) checkUpstreams() {
+	var wg sync.WaitGroup
+	for i, v := range s.upstreams {
+		wg.Add(1)
+		go func(node *rpc.RPCClient, h *upstreamHealth) {
+			defer wg.Done()
+			start := time.Now()
+			ok := node.Check()
+			latency := time.Since(start)
+
+			var height uint64
+			if ok {
+				block, err := node.GetPendingBlock()
+				if err != nil || block == nil {
+					ok = false
+				} else {
+					height, _ = strconv.ParseUint(strings.Replace(block.Number, "0x", "", -1), 16, 64)
+				}
+			}
+			h.record(ok, height, latency)
+		}(v, s.health[i])
+	}
+	wg.Wait()
+
+	current := int(atomic.LoadInt32(&s.upstream))
+	candidate, reason := selectUpstream(current, s.health, s.upstreamMaxLag)
+	if candidate != current {
+		from, to := s.upstreams[current].Name, s.upstreams[candidate].Name
+		log.Printf("Switching from %v to %v upstream: %v", from, to, reason)
+		atomic.StoreInt32(&s.upstream, int32(candidate))
+		if err := s.backend.WriteUpstreamEvent(s.config.Name, from, to, reason); err != nil {
+			log.Printf("Failed to write upstream switch to backend: %v", err)
+		}
+	}
+
+	states := make([]*storage.UpstreamState, len(s.upstreams))
+	for i, v := range s.upstreams {
+		h := s.health[i]
+		states[i] = &storage.UpstreamState{
+			Name:      v.Name,
+			Height:    h.height,
+			Latency:   int64(h.latency / time.Millisecond),
+			ErrorRate: h.errorRate(),
+			Healthy:   h.healthy,
+			Active:    i == candidate,
+		}
+	}
+	if err := s.backend.WriteUpstreamStates(s.config.Name, states); err != nil {
+		log.Printf("Failed to write upstream states to backend: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func testHealth(ok bool, height uint64, latency time.Duration) *upstreamHealth {
+	h := &upstreamHealth{}
+	h.record(ok, height, latency)
+	return h
+}
+
+func TestSelectUpstreamLagging(t *testing.T) {
+	health := []*upstreamHealth{
+		testHealth(true, 100, 10*time.Millisecond),
+		testHealth(true, 105, 50*time.Millisecond),
+	}
+	i, reason := selectUpstream(0, health, 2)
+	if i != 1 || reason != "5 blocks behind" {
+		t.Errorf("Must switch away from lagging node, got %v %q", i, reason)
+	}
+}
+
+func TestSelectUpstreamUnhealthy(t *testing.T) {
+	health := []*upstreamHealth{
+		testHealth(false, 0, 0),
+		testHealth(true, 100, 50*time.Millisecond),
+	}
+	if i, reason := selectUpstream(0, health, 2); i != 1 || reason != "unhealthy" {
+		t.Errorf("Must switch away from failed node, got %v %q", i, reason)
+	}
+	health[1].record(false, 0, 0)
+	if i, _ := selectUpstream(0, health, 2); i != 0 {
+		t.Errorf("Must keep current node when nothing is better, got %v", i)
+	}
+}
+
+func TestSelectUpstreamHysteresis(t *testing.T) {
+	health := []*upstreamHealth{
+		testHealth(true, 100, 40*time.Millisecond),
+		testHealth(true, 101, 30*time.Millisecond),
+	}
+	if i, _ := selectUpstream(0, health, 2); i != 0 {
+		t.Errorf("Slightly faster node must not cause a switch, got %v", i)
+	}
+	health[0].record(false, 0, 0)
+	health[0].record(true, 100, 40*time.Millisecond)
+	if i, _ := selectUpstream(0, health, 2); i != 1 {
+		t.Errorf("Node with errors must be replaced by a reliable one, got %v", i)
+	}
+}
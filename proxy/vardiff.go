@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/virbicoin/open-virbicoin-pool/util"
+)
+
+// Number of recent jobs we remember difficulty for, enough to cover template backlog
+const maxJobDiffs = 16
+
+type varDiffOptions struct {
+	minDiff      int64
+	maxDiff      int64
+	targetTime   float64
+	retargetTime int64
+	variance     float64
+}
+
+type varDiff struct {
+	sync.Mutex
+	opts       *varDiffOptions
+	diff       int64
+	nextDiff   int64
+	lastJob    string
+	jobs       map[string]int64
+	jobsOrder  []string
+	retargetAt int64
+	shares     int64
+	lastSeen   int64
+}
+
+func newVarDiffOptions(cfg *VarDiff) *varDiffOptions {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.MinDiff <= 0 || cfg.MaxDiff < cfg.MinDiff {
+		log.Fatalf("Invalid vardiff range: %v - %v", cfg.MinDiff, cfg.MaxDiff)
+	}
+	targetTime := util.MustParseDuration(cfg.TargetTime)
+	retargetTime := util.MustParseDuration(cfg.RetargetTime)
+	log.Printf("Vardiff enabled: %v - %v, share every %v, retarget every %v", cfg.MinDiff, cfg.MaxDiff, targetTime, retargetTime)
+	return &varDiffOptions{
+		minDiff:      cfg.MinDiff,
+		maxDiff:      cfg.MaxDiff,
+		targetTime:   float64(targetTime / time.Millisecond),
+		retargetTime: int64(retargetTime / time.Millisecond),
+		variance:     cfg.VariancePercent / 100.0,
+	}
+}
+
+// Pass nil options for a fixed difficulty
+func newVarDiff(diff int64, opts *varDiffOptions) *varDiff {
+	now := util.MakeTimestamp()
+	if opts != nil {
+		diff = opts.clamp(diff)
+	}
+	return &varDiff{opts: opts, diff: diff, jobs: make(map[string]int64), retargetAt: now, lastSeen: now}
+}
+
+func (o *varDiffOptions) clamp(diff int64) int64 {
+	if diff < o.minDiff {
+		return o.minDiff
+	}
+	if diff > o.maxDiff {
+		return o.maxDiff
+	}
+	return diff
+}
+
+func (v *varDiff) current() int64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.diff
+}
+
+// Returns difficulty a job must be sent with and whether it differs from the previous job.
+// Pending retarget is applied only when miner switches to a new job.
+func (v *varDiff) jobDiff(header string) (int64, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	now := util.MakeTimestamp()
+	v.lastSeen = now
+	if header == v.lastJob {
+		return v.diff, false
+	}
+	changed := len(v.lastJob) == 0
+	v.retarget(now)
+	if v.nextDiff > 0 {
+		changed = changed || v.nextDiff != v.diff
+		v.diff = v.nextDiff
+		v.nextDiff = 0
+	}
+	v.lastJob = header
+
+	if _, ok := v.jobs[header]; !ok {
+		v.jobsOrder = append(v.jobsOrder, header)
+		if len(v.jobsOrder) > maxJobDiffs {
+			delete(v.jobs, v.jobsOrder[0])
+			v.jobsOrder = v.jobsOrder[1:]
+		}
+	}
+	v.jobs[header] = v.diff
+	return v.diff, changed
+}
+
+// Returns difficulty miner was given along with a job
+func (v *varDiff) shareDiff(header string) int64 {
+	v.Lock()
+	defer v.Unlock()
+	if diff, ok := v.jobs[header]; ok {
+		return diff
+	}
+	return v.diff
+}
+
+func (v *varDiff) submit() {
+	if v.opts == nil {
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.shares++
+	v.retarget(util.MakeTimestamp())
+}
+
+func (v *varDiff) retarget(now int64) {
+	if v.opts == nil {
+		return
+	}
+	elapsed := now - v.retargetAt
+	if elapsed < v.opts.retargetTime {
+		return
+	}
+	shares := v.shares
+	v.retargetAt = now
+	v.shares = 0
+
+	// Without shares in a window we only know that miner is slower than that
+	avg := float64(elapsed)
+	if shares > 0 {
+		avg = avg / float64(shares)
+	}
+	target := v.opts.targetTime
+	variance := target * v.opts.variance
+	if avg >= target-variance && avg <= target+variance {
+		return
+	}
+
+	diff := v.diff
+	if v.nextDiff > 0 {
+		diff = v.nextDiff
+	}
+	next := v.opts.clamp(int64(float64(diff) * target / avg))
+	if next != v.diff {
+		v.nextDiff = next
+	} else {
+		v.nextDiff = 0
+	}
+}
+
+func (v *varDiff) idle(now, ttl int64) bool {
+	v.Lock()
+	defer v.Unlock()
+	return now-v.lastSeen > ttl
+}
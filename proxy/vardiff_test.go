@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/virbicoin/open-virbicoin-pool/util"
+)
+
+func testVarDiffOptions() *varDiffOptions {
+	return &varDiffOptions{minDiff: 100, maxDiff: 100000, targetTime: 10000, retargetTime: 60000, variance: 0.3}
+}
+
+func TestVarDiffFixed(t *testing.T) {
+	v := newVarDiff(5000, nil)
+	v.retargetAt -= 3600000
+	for i := 0; i < 1000; i++ {
+		v.submit()
+	}
+	if diff, _ := v.jobDiff("0x1"); diff != 5000 {
+		t.Errorf("Fixed difficulty must not change, got %v", diff)
+	}
+}
+
+func TestVarDiffRetargetUp(t *testing.T) {
+	v := newVarDiff(1000, testVarDiffOptions())
+	if diff, changed := v.jobDiff("0x1"); diff != 1000 || !changed {
+		t.Errorf("First job must carry starting difficulty")
+	}
+	// 60 shares in a minute while we want one share in 10 seconds
+	v.retargetAt = util.MakeTimestamp() - 60000
+	v.shares = 59
+	v.submit()
+
+	if diff := v.shareDiff("0x1"); diff != 1000 {
+		t.Errorf("Share for a sent job must be checked against its difficulty, got %v", diff)
+	}
+	if diff, changed := v.jobDiff("0x1"); diff != 1000 || changed {
+		t.Errorf("Difficulty must not change within the same job")
+	}
+	diff, changed := v.jobDiff("0x2")
+	if !changed || diff < 9900 || diff > 10100 {
+		t.Errorf("Difficulty must be raised with the next job, got %v", diff)
+	}
+	if diff := v.shareDiff("0x1"); diff != 1000 {
+		t.Errorf("Late share for previous job must keep its difficulty, got %v", diff)
+	}
+}
+
+func TestVarDiffRetargetDownClamped(t *testing.T) {
+	v := newVarDiff(1000, testVarDiffOptions())
+	v.jobDiff("0x1")
+	// No shares at all for 10 minutes
+	v.retargetAt = util.MakeTimestamp() - 600000
+
+	diff, changed := v.jobDiff("0x2")
+	if !changed || diff != 100 {
+		t.Errorf("Difficulty must be lowered to minimum, got %v", diff)
+	}
+}
@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+type Head struct {
+	Number string `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+func (h *Head) Height() int64 {
+	height, _ := strconv.ParseInt(strings.Replace(h.Number, "0x", "", -1), 16, 64)
+	return height
+}
+
+/* Subscription to eth newHeads over websocket. New pending transactions
+ * change pending work, they come on Pending if node supports it, Pending is
+ * nil otherwise.
+ */
+type HeadSubscription struct {
+	Heads   chan *Head
+	Pending chan string
+	client  *gethrpc.Client
+	sub     *gethrpc.ClientSubscription
+	pending *gethrpc.ClientSubscription
+	errs    chan error
+}
+
+func SubscribeNewHeads(ctx context.Context, url string) (*HeadSubscription, error) {
+	client, err := gethrpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	heads := make(chan *Head, 16)
+	sub, err := client.EthSubscribe(ctx, heads, "newHeads")
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	s := &HeadSubscription{Heads: heads, client: client, sub: sub, errs: make(chan error, 1)}
+	pending := make(chan string, 256)
+	psub, err := client.EthSubscribe(ctx, pending, "newPendingTransactions")
+	if err != nil {
+		go func() { s.errs <- <-sub.Err() }()
+		return s, nil
+	}
+	s.Pending, s.pending = pending, psub
+	go func() {
+		select {
+		case err := <-sub.Err():
+			s.errs <- err
+		case err := <-psub.Err():
+			s.errs <- err
+		}
+	}()
+	return s, nil
+}
+
+// Receives an error once either subscription drops
+func (s *HeadSubscription) Err() <-chan error {
+	return s.errs
+}
+
+func (s *HeadSubscription) Close() {
+	s.sub.Unsubscribe()
+	if s.pending != nil {
+		s.pending.Unsubscribe()
+	}
+	s.client.Close()
+}
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+type testEth struct {
+	pending bool
+}
+
+func (e *testEth) NewHeads(ctx context.Context) (*gethrpc.Subscription, error) {
+	notifier, _ := gethrpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go notifier.Notify(sub.ID, &Head{Number: "0x10", Hash: "0x1"})
+	return sub, nil
+}
+
+func (e *testEth) NewPendingTransactions(ctx context.Context) (*gethrpc.Subscription, error) {
+	if !e.pending {
+		return nil, gethrpc.ErrNotificationsUnsupported
+	}
+	notifier, _ := gethrpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go notifier.Notify(sub.ID, "0x2")
+	return sub, nil
+}
+
+func testNode(t *testing.T, eth *testEth) string {
+	server := gethrpc.NewServer()
+	if err := server.RegisterName("eth", eth); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server.WebsocketHandler([]string{"*"}))
+	t.Cleanup(func() {
+		srv.Close()
+		server.Stop()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestSubscribeNewHeads(t *testing.T) {
+	ctx := context.Background()
+	sub, err := SubscribeNewHeads(ctx, testNode(t, &testEth{pending: true}))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	select {
+	case head := <-sub.Heads:
+		if head.Height() != 16 {
+			t.Errorf("Head height must be 16, got %v", head.Height())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Head must be delivered")
+	}
+	if sub.Pending == nil {
+		t.Fatal("Pending transactions must be subscribed when node supports it")
+	}
+	select {
+	case hash := <-sub.Pending:
+		if hash != "0x2" {
+			t.Errorf("Wrong pending transaction %v", hash)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending transaction must be delivered")
+	}
+}
+
+func TestSubscribeNewHeadsWithoutPending(t *testing.T) {
+	sub, err := SubscribeNewHeads(context.Background(), testNode(t, &testEth{}))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+	if sub.Pending != nil {
+		t.Error("Pending must be nil when node does not support it")
+	}
+}
+
+func TestSubscriptionDrop(t *testing.T) {
+	url := testNode(t, &testEth{})
+	sub, err := SubscribeNewHeads(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	sub.client.Close()
+	select {
+	case <-sub.Err():
+	case <-time.After(time.Second):
+		t.Fatal("Dropped subscription must report an error")
+	}
+}
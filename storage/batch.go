@@ -0,0 +1,466 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/virbicoin/open-virbicoin-pool/util"
+)
+
+const (
+	flushRetryInterval = time.Second
+	// Long enough for a shutdown journal to be replayed
+	pendingMarkExpire = 7 * 24 * time.Hour
+)
+
+type batchWorker struct {
+	login string
+	id    string
+}
+
+type batchHashrate struct {
+	diff int64
+	ms   int64
+}
+
+type batchStat struct {
+	login string
+	id    string
+	kind  string
+}
+
+/* Share writes aggregated in memory per login and worker. Hashrate of a worker
+ * goes as a single entry per flush carrying summed difficulty, which adds up
+ * to the same hashrate over window.
+ */
+type shareBatch struct {
+	round       map[string]int64
+	roundShares int64
+	hashrate    map[batchWorker]*batchHashrate
+	stats       map[batchStat]int64
+	// Highest share height, PoW backlog below it is swept on write
+	height uint64
+	expire time.Duration
+}
+
+func newShareBatch() *shareBatch {
+	return &shareBatch{
+		round:    make(map[string]int64),
+		hashrate: make(map[batchWorker]*batchHashrate),
+		stats:    make(map[batchStat]int64),
+	}
+}
+
+func (b *shareBatch) empty() bool {
+	return len(b.round) == 0 && len(b.hashrate) == 0 && len(b.stats) == 0 && b.height == 0
+}
+
+// Share counted toward shared round
+func (b *shareBatch) credit(login string, diff int64) {
+	b.round[login] += diff
+	b.roundShares += diff
+}
+
+func (b *shareBatch) addHashrate(login, id string, diff, ms int64) {
+	k := batchWorker{login, id}
+	h, ok := b.hashrate[k]
+	if !ok {
+		h = &batchHashrate{}
+		b.hashrate[k] = h
+	}
+	h.diff += diff
+	if ms > h.ms {
+		h.ms = ms
+	}
+}
+
+func (b *shareBatch) addStat(login, id, kind string, n int64) {
+	b.stats[batchStat{login, id, kind}] += n
+}
+
+func (b *shareBatch) touch(height uint64, expire time.Duration) {
+	if height > b.height {
+		b.height = height
+	}
+	if expire > b.expire {
+		b.expire = expire
+	}
+}
+
+func (b *shareBatch) merge(o *shareBatch) {
+	for login, diff := range o.round {
+		b.round[login] += diff
+	}
+	b.roundShares += o.roundShares
+	for k, h := range o.hashrate {
+		b.addHashrate(k.login, k.id, h.diff, h.ms)
+	}
+	for k, n := range o.stats {
+		b.addStat(k.login, k.id, k.kind, n)
+	}
+	b.touch(o.height, o.expire)
+}
+
+// Command queued for a transaction or for gatedWrite script
+type redisCmd struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+	Args []string `json:"args,omitempty"`
+}
+
+type redisCmds []redisCmd
+
+// Most commands take a single key
+func (c *redisCmds) add(name, key string, args ...interface{}) {
+	c.addKeys(name, []string{key}, args...)
+}
+
+func (c *redisCmds) addKeys(name string, keys []string, args ...interface{}) {
+	cmd := redisCmd{Name: name, Keys: keys, Args: make([]string, len(args))}
+	for i, arg := range args {
+		cmd.Args[i] = fmt.Sprint(arg)
+	}
+	*c = append(*c, cmd)
+}
+
+/* Runs queued commands unless the first one finds the write already done, the
+ * last one marks it done. Scripts do not roll back, so a failed command stops
+ * the script with an error before the mark and the write can be retried,
+ * commands run before the failure stay and may count twice then.
+ * All keys go in KEYS, taken in order by commands. ARGV holds each command as
+ * number of its keys, number of its args, name and args.
+ * CANDIDATE adds block candidate carrying total of round shares, unlocker
+ * splits reward by it. CLOSEROUND renames current round into block round
+ * unless a block above given height was found since.
+ */
+var gatedWrite = redis.NewScript(`
+local k, i = 1, 1
+local function nextCmd()
+	local nkeys, nargs = tonumber(ARGV[i]), tonumber(ARGV[i + 1])
+	local cmd = {ARGV[i + 2]}
+	for j = k, k + nkeys - 1 do
+		cmd[#cmd + 1] = KEYS[j]
+	end
+	for j = i + 3, i + 2 + nargs do
+		cmd[#cmd + 1] = ARGV[j]
+	end
+	k, i = k + nkeys, i + 3 + nargs
+	return cmd
+end
+
+local function failed(reply)
+	return type(reply) == 'table' and reply.err ~= nil
+end
+
+local function candidate(round, candidates, score, prefix)
+	local shares = redis.pcall('HVALS', round)
+	if failed(shares) then
+		return shares
+	end
+	local total = 0
+	for _, v in ipairs(shares) do
+		total = total + tonumber(v)
+	end
+	return redis.pcall('ZADD', candidates, score, prefix .. ':' .. string.format('%.0f', total))
+end
+
+local function closeRound(current, round, candidates, immature, stats, height)
+	for _, key in ipairs({candidates, immature}) do
+		local n = redis.pcall('ZCOUNT', key, '(' .. height, '+inf')
+		if failed(n) or n > 0 then
+			return n
+		end
+	end
+	local n = redis.pcall('EXISTS', current)
+	if failed(n) or n == 0 then
+		return n
+	end
+	local reply = redis.pcall('RENAME', current, round)
+	if failed(reply) then
+		return reply
+	end
+	return redis.pcall('HDEL', stats, 'roundShares')
+end
+
+local found = redis.pcall(unpack(nextCmd()))
+if failed(found) then
+	return found
+end
+if found and found ~= 0 then
+	return 0
+end
+while i <= #ARGV do
+	local cmd = nextCmd()
+	local reply
+	if cmd[1] == 'CANDIDATE' then
+		reply = candidate(unpack(cmd, 2))
+	elseif cmd[1] == 'CLOSEROUND' then
+		reply = closeRound(unpack(cmd, 2))
+	else
+		reply = redis.pcall(unpack(cmd))
+	end
+	if failed(reply) then
+		return reply
+	end
+end
+return 1
+`)
+
+// Returns false if first command found the write done and nothing was written
+func (r *RedisClient) runGated(cmds redisCmds) (bool, error) {
+	var keys, args []string
+	for _, cmd := range cmds {
+		keys = append(keys, cmd.Keys...)
+		args = append(args, strconv.Itoa(len(cmd.Keys)), strconv.Itoa(len(cmd.Args)), cmd.Name)
+		args = append(args, cmd.Args...)
+	}
+	v, err := gatedWrite.Run(r.client, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n == 1, nil
+}
+
+func (r *RedisClient) execCmds(cmds redisCmds) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for _, cmd := range cmds {
+			args := []interface{}{cmd.Name}
+			for _, key := range cmd.Keys {
+				args = append(args, key)
+			}
+			for _, arg := range cmd.Args {
+				args = append(args, arg)
+			}
+			tx.Process(redis.NewCmd(args...))
+		}
+		return nil
+	})
+	return err
+}
+
+/* Share is written only if its PoW is new. PoW is recorded after the writes,
+ * so PoW found in backend means the share is there.
+ */
+func (r *RedisClient) writeOnce(height uint64, params []string, cmds redisCmds) (bool, error) {
+	pow := strings.Join(params, ":")
+	gated := redisCmds{}
+	gated.add("ZSCORE", r.formatKey("pow"), pow)
+	gated = append(gated, cmds...)
+	gated.add("ZADD", r.formatKey("pow"), height, pow)
+	return r.runGated(gated)
+}
+
+func (r *RedisClient) writeBatch(cmds *redisCmds, b *shareBatch, ts int64) {
+	if b.height > 0 {
+		// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+		cmds.add("ZREMRANGEBYSCORE", r.formatKey("pow"), "-inf", fmt.Sprint("(", b.height-8))
+	}
+	for login, diff := range b.round {
+		cmds.add("HINCRBY", r.formatKey("shares", "roundCurrent"), login, diff)
+	}
+	if b.roundShares > 0 {
+		cmds.add("HINCRBY", r.formatKey("stats"), "roundShares", b.roundShares)
+	}
+	lastShare := make(map[string]int64)
+	for k, h := range b.hashrate {
+		score := h.ms / 1000
+		cmds.add("ZADD", r.formatKey("hashrate"), score, join(h.diff, k.login, k.id, h.ms))
+		cmds.add("ZADD", r.formatKey("hashrate", k.login), score, join(h.diff, k.id, h.ms))
+		if score > lastShare[k.login] {
+			lastShare[k.login] = score
+		}
+	}
+	for login, score := range lastShare {
+		cmds.add("EXPIRE", r.formatKey("hashrate", login), int64(b.expire/time.Second)) // Will delete hashrates for miners that gone
+		cmds.add("HSET", r.formatKey("miners", login), "lastShare", score)
+	}
+	// Counter is named by share kind or by reject reason
+	for k, n := range b.stats {
+		key := r.formatKey("sharestats", k.login, ts/shareStatsBucket)
+		cmds.add("HINCRBY", key, join(k.id, k.kind), n)
+		cmds.add("EXPIRE", key, int64((b.expire+shareStatsBucket*time.Second)/time.Second))
+	}
+}
+
+// Shares are kept in memory and written every interval instead of one by one
+func (r *RedisClient) StartShareBatching(interval time.Duration) {
+	r.batchMu.Lock()
+	r.batch = newShareBatch()
+	r.batchMu.Unlock()
+	r.flushQuit = make(chan struct{})
+	r.flushDone = make(chan struct{})
+	log.Printf("Flushing shares to backend every %v", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer close(r.flushDone)
+		for {
+			select {
+			case <-r.flushQuit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if err := r.FlushShares(); err != nil {
+					log.Printf("Failed to flush shares to backend: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+/* Shares left in memory when backend stays down at shutdown, kept as commands
+ * writing them. Their PoW is recorded already, so they can not be replayed as
+ * shares, WritePendingShares writes them once by Id instead.
+ */
+type PendingShares struct {
+	Id   string     `json:"id"`
+	Cmds []redisCmd `json:"cmds"`
+}
+
+/* Writes what is left in memory, call it when no more shares come in. Failed
+ * flush is retried until ctx is done, then shares left are returned to be kept
+ * elsewhere, they are lost otherwise.
+ */
+func (r *RedisClient) StopShareBatching(ctx context.Context) (*PendingShares, error) {
+	if r.flushQuit == nil {
+		return nil, nil
+	}
+	close(r.flushQuit)
+	<-r.flushDone
+	r.flushQuit = nil
+
+	for {
+		err := r.FlushShares()
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to flush pending shares to backend: %v", err)
+		select {
+		case <-ctx.Done():
+			r.batchMu.Lock()
+			b := r.batch
+			r.batch = nil
+			r.batchMu.Unlock()
+			return r.pendingShares(b), err
+		case <-time.After(flushRetryInterval):
+		}
+	}
+	r.batchMu.Lock()
+	r.batch = nil
+	r.batchMu.Unlock()
+	return nil, nil
+}
+
+func (r *RedisClient) pendingShares(b *shareBatch) *PendingShares {
+	if b == nil || b.empty() {
+		return nil
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	ms := util.MakeTimestamp()
+	p := &PendingShares{Id: fmt.Sprintf("%d-%x", ms, id)}
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, ms/1000)
+	p.Cmds = cmds
+	return p
+}
+
+// Returns true if shares were written already
+func (r *RedisClient) WritePendingShares(p *PendingShares) (bool, error) {
+	key := r.formatKey("pending", p.Id)
+	var cmds redisCmds
+	cmds.add("EXISTS", key)
+	cmds = append(cmds, p.Cmds...)
+	cmds.add("SET", key, 1, "EX", int64(pendingMarkExpire/time.Second))
+	ok, err := r.runGated(cmds)
+	return !ok && err == nil, err
+}
+
+// Failed batch stays in memory and goes with the next flush
+func (r *RedisClient) FlushShares() error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	b := r.takeBatch()
+	if b == nil || b.empty() {
+		return nil
+	}
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, util.MakeTimestamp()/1000)
+	err := r.execCmds(cmds)
+	if err != nil {
+		r.returnBatch(b)
+	}
+	return err
+}
+
+func (r *RedisClient) takeBatch() *shareBatch {
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	b := r.batch
+	if b != nil {
+		r.batch = newShareBatch()
+	}
+	return b
+}
+
+func (r *RedisClient) returnBatch(b *shareBatch) {
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	if r.batch != nil {
+		r.batch.merge(b)
+	}
+}
+
+// Adds share to pending batch, or writes it right away if batching is off
+func (r *RedisClient) addToBatch(fn func(b *shareBatch)) error {
+	r.batchMu.Lock()
+	if r.batch != nil {
+		fn(r.batch)
+		r.batchMu.Unlock()
+		return nil
+	}
+	r.batchMu.Unlock()
+
+	b := newShareBatch()
+	fn(b)
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, util.MakeTimestamp()/1000)
+	return r.execCmds(cmds)
+}
+
+func (r *RedisClient) batching() bool {
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	return r.batch != nil
+}
+
+/* Share goes to backend only if its PoW is new. Pending batch has already
+ * passed the check, otherwise check and write go in one script.
+ */
+func (r *RedisClient) addShare(height uint64, params []string, fn func(b *shareBatch)) (bool, error) {
+	if r.batching() {
+		exist, err := r.checkPoWExist(height, params)
+		if err != nil || exist {
+			return exist, err
+		}
+		return false, r.addToBatch(fn)
+	}
+	b := newShareBatch()
+	fn(b)
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, util.MakeTimestamp()/1000)
+	ok, err := r.writeOnce(height, params, cmds)
+	return !ok && err == nil, err
+}
@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/redis.v3"
@@ -32,6 +35,13 @@ type RedisClient struct {
 	client *redis.Client
 	prefix string
 	actualPassword string // Track the actual working password
+
+	// Pending shares, nil unless batching is on
+	batchMu   sync.Mutex
+	batch     *shareBatch
+	flushMu   sync.Mutex
+	flushQuit chan struct{}
+	flushDone chan struct{}
 }
 
 type BlockData struct {
@@ -51,6 +61,8 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
+	Solo           bool     `json:"solo"` // Solo block pays only the miner who found it
+	Finder         string   `json:"finder,omitempty"`
 	candidateKey   string
 	immatureKey    string
 }
@@ -73,6 +85,9 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
+	if b.Solo {
+		return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Finder)
+	}
 	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
 }
 
@@ -83,11 +98,44 @@ type Miner struct {
 	startedAt int64
 }
 
+type UpstreamState struct {
+	Name      string  `json:"name"`
+	Node      string  `json:"node"`
+	Height    uint64  `json:"height"`
+	Latency   int64   `json:"latency"`
+	ErrorRate float64 `json:"errorRate"`
+	Healthy   bool    `json:"healthy"`
+	Active    bool    `json:"active"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+type UpstreamEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Node      string `json:"node"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Reason    string `json:"reason"`
+}
+
+// Number of upstream switches kept for API
+const maxUpstreamEvents = 100
+
 type Worker struct {
 	Miner
 	TotalHR int64 `json:"hr2"`
+	// Hashrate claimed by mining software with eth_submitHashrate
+	ReportedHR int64 `json:"reportedHr"`
+	ReportedAt int64 `json:"reportedAt"`
+	// Share counters over large window
+	ValidShares     int64            `json:"validShares"`
+	StaleShares     int64            `json:"staleShares"`
+	DuplicateShares int64            `json:"duplicateShares"`
+	RejectedShares  map[string]int64 `json:"rejectedShares,omitempty"`
 }
 
+// Share counters are kept in buckets of this many seconds to roll them over large window
+const shareStatsBucket = 600
+
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 	var client *redis.Client
 	var err error
@@ -224,6 +272,16 @@ func (r *RedisClient) Check() (string, error) {
 	return r.client.Ping().Result()
 }
 
+// Proxy flushes pending shares on its own shutdown, this is the last resort
+func (r *RedisClient) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := r.StopShareBatching(ctx); err != nil {
+		log.Printf("Pending shares are lost: %v", err)
+	}
+	return r.client.Close()
+}
+
 func (r *RedisClient) BgSave() (string, error) {
 	return r.client.BgSave().Result()
 }
@@ -246,6 +304,132 @@ func (r *RedisClient) GetWhitelist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
+type BanEntry struct {
+	IP        string `json:"ip"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Instance  string `json:"instance"`
+	Reason    string `json:"reason"`
+}
+
+// Offence recorded along with a ban, times are in seconds
+type OffenceEntry struct {
+	At       int64
+	Timeout  int64
+	Instance string
+	Reason   string
+}
+
+/* Ban recorded by one proxy instance is picked up by all others. Offence goes
+ * to history of the address kept for window, so ban escalates on any instance
+ * and after restart.
+ */
+func (r *RedisClient) WriteBan(ban *BanEntry, window time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	key := r.formatKey("offences", ban.IP)
+
+	_, err := tx.Exec(func() error {
+		tx.HSet(r.formatKey("bans"), ban.IP, join(ban.BannedAt, ban.ExpiresAt, ban.Instance, ban.Reason))
+		tx.ZAdd(key, redis.Z{Score: float64(ban.BannedAt), Member: join(ban.BannedAt, ban.ExpiresAt-ban.BannedAt, ban.Instance, ban.Reason)})
+		tx.ZRemRangeByScore(key, "-inf", fmt.Sprint("(", ban.BannedAt-int64(window/time.Second)))
+		tx.Expire(key, window)
+		return nil
+	})
+	return err
+}
+
+// Offences of an address since given time, oldest first
+func (r *RedisClient) GetOffences(ip string, since int64) ([]*OffenceEntry, error) {
+	members, err := r.client.ZRangeByScore(r.formatKey("offences", ip), redis.ZRangeByScore{Min: strconv.FormatInt(since, 10), Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*OffenceEntry, 0, len(members))
+	for _, v := range members {
+		fields := strings.SplitN(v, ":", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		offence := &OffenceEntry{Instance: fields[2], Reason: fields[3]}
+		offence.At, _ = strconv.ParseInt(fields[0], 10, 64)
+		offence.Timeout, _ = strconv.ParseInt(fields[1], 10, 64)
+		result = append(result, offence)
+	}
+	return result, nil
+}
+
+/* Lift is kept for a day, so other instances lift their copy of the ban too.
+ * Offence history goes away, so the next ban of the address starts over.
+ */
+func (r *RedisClient) RemoveBan(ip string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	now := util.MakeTimestamp()
+
+	_, err := tx.Exec(func() error {
+		tx.HDel(r.formatKey("bans"), ip)
+		tx.Del(r.formatKey("offences", ip))
+		tx.HSet(r.formatKey("bans", "lifted"), ip, strconv.FormatInt(now, 10))
+		tx.Expire(r.formatKey("bans", "lifted"), 24*time.Hour)
+		return nil
+	})
+	return err
+}
+
+// Returns time of lift in milliseconds by address
+func (r *RedisClient) GetLiftedBans() (map[string]int64, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("bans", "lifted"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make(map[string]int64)
+	for ip, v := range cmd.Val() {
+		result[ip], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return result, nil
+}
+
+// List is either blacklist or whitelist
+func (r *RedisClient) UpdatePolicyList(list, entry string, add bool) error {
+	if add {
+		return r.client.SAdd(r.formatKey(list), entry).Err()
+	}
+	return r.client.SRem(r.formatKey(list), entry).Err()
+}
+
+// Returns bans in force, expired ones are removed on the way
+func (r *RedisClient) GetBans() ([]*BanEntry, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("bans"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	now := util.MakeTimestamp() / 1000
+	var result []*BanEntry
+	var expired []string
+	for ip, v := range cmd.Val() {
+		fields := strings.SplitN(v, ":", 4)
+		if len(fields) != 4 {
+			expired = append(expired, ip)
+			continue
+		}
+		ban := &BanEntry{IP: ip, Instance: fields[2], Reason: fields[3]}
+		ban.BannedAt, _ = strconv.ParseInt(fields[0], 10, 64)
+		ban.ExpiresAt, _ = strconv.ParseInt(fields[1], 10, 64)
+		if ban.ExpiresAt <= now {
+			expired = append(expired, ip)
+			continue
+		}
+		result = append(result, ban)
+	}
+	if len(expired) > 0 {
+		r.client.HDel(r.formatKey("bans"), expired...)
+	}
+	return result, nil
+}
+
 func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
 	tx := r.client.Multi()
 	defer tx.Close()
@@ -278,6 +462,20 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
 	return err
 }
 
+// State of verification cache of the next epoch is one of cold, warming and ready
+func (r *RedisClient) WriteNodeEpoch(id string, epoch, nextEpoch uint64, nextCache string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HSet(r.formatKey("nodes"), join(id, "epoch"), strconv.FormatUint(epoch, 10))
+		tx.HSet(r.formatKey("nodes"), join(id, "nextEpoch"), strconv.FormatUint(nextEpoch, 10))
+		tx.HSet(r.formatKey("nodes"), join(id, "nextEpochCache"), nextCache)
+		return nil
+	})
+	return err
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
@@ -303,83 +501,265 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	return v, nil
 }
 
+// State of upstreams as seen by proxy instance, keyed by instance and upstream name
+func (r *RedisClient) WriteUpstreamStates(node string, states []*UpstreamState) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	now := util.MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		for _, v := range states {
+			value := join(v.Height, v.Latency, strconv.FormatFloat(v.ErrorRate, 'f', 4, 64), v.Healthy, v.Active, now)
+			tx.HSet(r.formatKey("upstreams"), join(node, v.Name), value)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetUpstreamStates() ([]*UpstreamState, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("upstreams"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	var result []*UpstreamState
+	for key, value := range cmd.Val() {
+		k := strings.SplitN(key, ":", 2)
+		fields := strings.Split(value, ":")
+		if len(k) != 2 || len(fields) != 6 {
+			continue
+		}
+		state := &UpstreamState{Node: k[0], Name: k[1]}
+		state.Height, _ = strconv.ParseUint(fields[0], 10, 64)
+		state.Latency, _ = strconv.ParseInt(fields[1], 10, 64)
+		state.ErrorRate, _ = strconv.ParseFloat(fields[2], 64)
+		state.Healthy = fields[3] == "1"
+		state.Active = fields[4] == "1"
+		state.UpdatedAt, _ = strconv.ParseInt(fields[5], 10, 64)
+		result = append(result, state)
+	}
+	return result, nil
+}
+
+func (r *RedisClient) WriteUpstreamEvent(node, from, to, reason string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	now := util.MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		// Reason is free text, so it goes last
+		tx.LPush(r.formatKey("upstreams", "events"), join(now, node, from, to, reason))
+		tx.LTrim(r.formatKey("upstreams", "events"), 0, maxUpstreamEvents-1)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetUpstreamEvents() ([]*UpstreamEvent, error) {
+	rows, err := r.client.LRange(r.formatKey("upstreams", "events"), 0, maxUpstreamEvents-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*UpstreamEvent, 0, len(rows))
+	for _, row := range rows {
+		fields := strings.SplitN(row, ":", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(fields[0], 10, 64)
+		result = append(result, &UpstreamEvent{Timestamp: ts, Node: fields[1], From: fields[2], To: fields[3], Reason: fields[4]})
+	}
+	return result, nil
+}
+
+// PoW backlog is swept along with batched writes
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
 	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
 	return val == 0, err
 }
 
+// Returns true if share is a duplicate, (nonce, powHash, mixDigest) pair exist
 func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
+	ms := util.MakeTimestamp()
+	return r.addShare(height, params, func(b *shareBatch) {
+		b.credit(login, diff)
+		b.addHashrate(login, id, diff, ms)
+		b.addStat(login, id, "valid", 1)
+		b.touch(height, window)
+	})
+}
+
+// Share for a job of previous block, credited to round only if asked to
+func (r *RedisClient) WriteStaleShare(login, id string, params []string, diff int64, height uint64, credit bool, window time.Duration) (bool, error) {
+	ms := util.MakeTimestamp()
+	return r.addShare(height, params, func(b *shareBatch) {
+		if credit {
+			b.credit(login, diff)
+			b.addHashrate(login, id, diff, ms)
+		}
+		b.addStat(login, id, "stale", 1)
+		b.touch(height, window)
+	})
+}
+
+/* Shares still pending in memory belong to the round being closed, so they
+ * are written in the same script right before round is renamed. Round and
+ * candidate go with the share, so PoW in backend means block is there.
+ */
+func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	pending := r.takeBatch()
+
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	b := newShareBatch()
+	b.credit(login, diff)
+	b.addHashrate(login, id, diff, ms)
+	b.addStat(login, id, "valid", 1)
+	b.touch(height, window)
+
+	round := r.formatRound(int64(height), params[0])
+	var cmds redisCmds
+	if pending != nil {
+		r.writeBatch(&cmds, pending, ts)
 	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
+	r.writeBatch(&cmds, b, ts)
+	cmds.add("HSET", r.formatKey("stats"), "lastBlockFound", ts)
+	cmds.add("HDEL", r.formatKey("stats"), "roundShares")
+	cmds.add("ZINCRBY", r.formatKey("finders"), 1, login)
+	cmds.add("HINCRBY", r.formatKey("miners", login), "blocksFound", 1)
+	cmds.addKeys("RENAME", []string{r.formatKey("shares", "roundCurrent"), round})
+	r.addCandidate(&cmds, round, height, join(strings.Join(params, ":"), ts, roundDiff))
+
+	ok, err := r.writeOnce(height, params, cmds)
+	if !ok && pending != nil {
+		r.returnBatch(pending)
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
+	return !ok && err == nil, err
+}
+
+/* Block from share journal closes current round as WriteBlock does, unless
+ * a newer block was found meanwhile. Then current round belongs to that one
+ * and block round gets finder's share only.
+ */
+func (r *RedisClient) ReplayBlock(login, id string, params []string, diff, roundDiff int64, height uint64, ts int64, window time.Duration) (bool, error) {
+	b := newShareBatch()
+	b.addHashrate(login, id, diff, ts*1000)
+	b.addStat(login, id, "valid", 1)
+	b.touch(height, window)
+
+	round := r.formatRound(int64(height), params[0])
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, ts)
+	keys := []string{
+		r.formatKey("shares", "roundCurrent"),
+		round,
+		r.formatKey("blocks", "candidates"),
+		r.formatKey("blocks", "immature"),
+		r.formatKey("stats"),
+	}
+	cmds.addKeys("CLOSEROUND", keys, height)
+	cmds.add("HINCRBY", round, login, diff)
+	cmds.add("ZINCRBY", r.formatKey("finders"), 1, login)
+	cmds.add("HINCRBY", r.formatKey("miners", login), "blocksFound", 1)
+	r.addCandidate(&cmds, round, height, join(strings.Join(params, ":"), ts, roundDiff))
+
+	ok, err := r.writeOnce(height, params, cmds)
+	return !ok && err == nil, err
+}
+
+// Candidate carries sum of round shares as of the write, unlocker splits reward by it
+func (r *RedisClient) addCandidate(cmds *redisCmds, round string, height uint64, prefix string) {
+	cmds.addKeys("CANDIDATE", []string{round, r.formatKey("blocks", "candidates")}, height, prefix)
+}
+
+// Solo miner's share does not go into shared round
+func (r *RedisClient) WriteSoloShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	ms := util.MakeTimestamp()
+	return r.addShare(height, params, func(b *shareBatch) {
+		b.addHashrate(login, id, diff, ms)
+		b.addStat(login, id, "valid", 1)
+		b.touch(height, window)
+	})
+}
 
+/* Solo round holds finder only, so unlocker credits the whole reward to the finder.
+ * Shared round goes on untouched.
+ */
+func (r *RedisClient) WriteSoloBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
-	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
-		return nil
+	b := newShareBatch()
+	b.addHashrate(login, id, diff, ms)
+	b.addStat(login, id, "valid", 1)
+	b.touch(height, window)
+
+	var cmds redisCmds
+	r.writeBatch(&cmds, b, ts)
+	cmds.add("HSET", r.formatKey("stats"), "lastSoloBlockFound", ts)
+	cmds.add("HINCRBY", r.formatKey("stats"), "soloBlocksFound", 1)
+	cmds.add("ZINCRBY", r.formatKey("finders"), 1, login)
+	cmds.add("HINCRBY", r.formatKey("miners", login), "blocksFound", 1)
+	cmds.add("HSET", r.formatRound(int64(height), params[0]), login, diff)
+	hashHex := strings.Join(params, ":")
+	cmds.add("ZADD", r.formatKey("blocks", "candidates"), height, join(hashHex, ts, roundDiff, diff, login))
+
+	ok, err := r.writeOnce(height, params, cmds)
+	return !ok && err == nil, err
+}
+
+func (r *RedisClient) WriteRejectedShare(login, id, reason string, expire time.Duration) error {
+	return r.addToBatch(func(b *shareBatch) {
+		b.addStat(login, id, reason, 1)
+		b.touch(0, expire)
 	})
-	return false, err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
-	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
+/* Each proxy keeps its own count of stratum sessions of a login, entry
+ * carries its expiration, so counts of a dead proxy are ignored.
+ */
+func (r *RedisClient) WriteSessionCounts(node string, counts map[string]int, expire time.Duration) error {
+	if len(counts) == 0 {
+		return nil
 	}
 	tx := r.client.Multi()
 	defer tx.Close()
 
-	ms := util.MakeTimestamp()
-	ts := ms / 1000
+	expiresAt := util.MakeTimestamp()/1000 + int64(expire/time.Second)
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+	_, err := tx.Exec(func() error {
+		for login, n := range counts {
+			key := r.formatKey("sessions", login)
+			if n == 0 {
+				tx.HDel(key, node)
+				continue
+			}
+			tx.HSet(key, node, join(n, expiresAt))
+			tx.Expire(key, expire)
+		}
 		return nil
 	})
-	if err != nil {
-		return false, err
-	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
-		totalShares := int64(0)
-		for _, v := range sharesMap {
-			n, _ := strconv.ParseInt(v, 10, 64)
-			totalShares += n
-		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
-	}
+	return err
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+func (r *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		tx.HSet(r.formatKey("reportedhr", login), id, join(hashrate, ts))
+		tx.Expire(r.formatKey("reportedhr", login), expire)
+		return nil
+	})
+	return err
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
@@ -831,6 +1211,8 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
+	stats["soloCandidatesTotal"] = countSoloBlocks(candidates)
+	stats["soloImmatureTotal"] = countSoloBlocks(immature)
 
 	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
 	stats["payments"] = payments
@@ -856,6 +1238,11 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	cmds, err := tx.Exec(func() error {
 		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
 		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+		tx.HGetAllMap(r.formatKey("reportedhr", login))
+		tx.HGetAllMap(r.formatKey("sessions", login))
+		for b := (now - largeWindow) / shareStatsBucket; b <= now/shareStatsBucket; b++ {
+			tx.HGetAllMap(r.formatKey("sharestats", login, b))
+		}
 		return nil
 	})
 
@@ -865,9 +1252,44 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
+	reportedHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
 	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	reported, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	sessions := convertSessionCounts(now, cmds[3].(*redis.StringStringMapCmd))
+	shares := convertShareStats(cmds[4:])
+
+	// Reports older than large window are as good as missing
+	reports := make(map[string][2]int64)
+	for id, v := range reported {
+		parts := strings.Split(v, ":")
+		if len(parts) == 2 {
+			hr, _ := strconv.ParseInt(parts[0], 10, 64)
+			ts, _ := strconv.ParseInt(parts[1], 10, 64)
+			if ts >= now-largeWindow {
+				reports[id] = [2]int64{hr, ts}
+			}
+		}
+	}
+
+	/* Worker sending only bad shares or only reporting hashrate has no effective
+	 * hashrate, but it is the one to diagnose. It is listed with its counters,
+	 * though it is neither online nor offline.
+	 */
+	noShares := make(map[string]bool)
+	for id := range shares {
+		if _, ok := workers[id]; !ok {
+			workers[id] = Worker{}
+			noShares[id] = true
+		}
+	}
+	for id := range reports {
+		if _, ok := workers[id]; !ok {
+			workers[id] = Worker{}
+			noShares[id] = true
+		}
+	}
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -887,15 +1309,38 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		}
 		worker.TotalHR = worker.TotalHR / boundary
 
-		if worker.LastBeat < (now - smallWindow/2) {
+		switch {
+		case noShares[id]:
+		case worker.LastBeat < (now - smallWindow/2):
 			worker.Offline = true
 			offline++
-		} else {
+		default:
 			online++
 		}
 
+		if v, ok := reports[id]; ok {
+			worker.ReportedHR, worker.ReportedAt = v[0], v[1]
+		}
+
+		for kind, n := range shares[id] {
+			switch kind {
+			case "valid":
+				worker.ValidShares = n
+			case "stale":
+				worker.StaleShares = n
+			case "duplicate":
+				worker.DuplicateShares = n
+			default:
+				if worker.RejectedShares == nil {
+					worker.RejectedShares = make(map[string]int64)
+				}
+				worker.RejectedShares[kind] = n
+			}
+		}
+
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
+		reportedHashrate += worker.ReportedHR
 		workers[id] = worker
 	}
 	stats["workers"] = workers
@@ -904,6 +1349,8 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
+	stats["reportedHashrate"] = reportedHashrate
+	stats["sessions"] = sessions
 	return stats, nil
 }
 
@@ -923,7 +1370,13 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 	if err != nil {
 		return stats, err
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+	var blocks []*BlockData
+	// Solo blocks say nothing about pool luck
+	for _, block := range convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd)) {
+		if !block.Solo {
+			blocks = append(blocks, block)
+		}
+	}
 
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
@@ -964,7 +1417,7 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+		// "nonce:powHash:mixDigest:timestamp:diff:totalShares[:soloFinder]"
 		block := BlockData{}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
@@ -975,6 +1428,10 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
 		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
 		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+		if len(fields) > 6 {
+			block.Solo = true
+			block.Finder = fields[6]
+		}
 		block.candidateKey = v.Member.(string)
 		result = append(result, &block)
 	}
@@ -985,7 +1442,7 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
 		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei[:soloFinder]"
 			block := BlockData{}
 			block.Height = int64(v.Score)
 			block.RoundHeight = block.Height
@@ -1000,6 +1457,10 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
 			block.RewardString = fields[7]
 			block.ImmatureReward = fields[7]
+			if len(fields) > 8 {
+				block.Solo = true
+				block.Finder = fields[8]
+			}
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -1007,6 +1468,16 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 	return result
 }
 
+func countSoloBlocks(blocks []*BlockData) int {
+	n := 0
+	for _, block := range blocks {
+		if block.Solo {
+			n++
+		}
+	}
+	return n
+}
+
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
 func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
@@ -1039,6 +1510,42 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
+// Sums stratum sessions of a login over all proxies
+func convertSessionCounts(now int64, raw *redis.StringStringMapCmd) int64 {
+	total := int64(0)
+	for _, v := range raw.Val() {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(parts[0], 10, 64)
+		expiresAt, _ := strconv.ParseInt(parts[1], 10, 64)
+		if expiresAt >= now {
+			total += n
+		}
+	}
+	return total
+}
+
+// Sums bucketed counters into worker -> kind -> count
+func convertShareStats(cmds []redis.Cmder) map[string]map[string]int64 {
+	result := make(map[string]map[string]int64)
+	for _, cmd := range cmds {
+		for k, v := range cmd.(*redis.StringStringMapCmd).Val() {
+			parts := strings.Split(k, ":")
+			if len(parts) != 2 {
+				continue
+			}
+			n, _ := strconv.ParseInt(v, 10, 64)
+			if result[parts[0]] == nil {
+				result[parts[0]] = make(map[string]int64)
+			}
+			result[parts[0]][parts[1]] += n
+		}
+	}
+	return result
+}
+
 func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
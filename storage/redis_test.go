@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
 )
@@ -335,6 +338,261 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestWriteStaleShare(t *testing.T) {
+	reset()
+
+	exist, _ := r.WriteStaleShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, false, time.Hour)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = r.WriteStaleShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, false, time.Hour)
+	if !exist {
+		t.Error("PoW must exist")
+	}
+	if n, _ := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Int64(); n != 0 {
+		t.Errorf("Stale share must not be credited, got %v", n)
+	}
+	r.WriteStaleShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 1008, true, time.Hour)
+	if n, _ := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Int64(); n != 100 {
+		t.Errorf("Stale share must be credited, got %v", n)
+	}
+}
+
+func TestWriteSoloBlock(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteSoloShare("z", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteSoloBlock("z", "rig1", []string{"0x2", "0x0", "0x0"}, 100, 5000, 1008, time.Hour)
+
+	round := r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Val()
+	if len(round) != 1 || round["x"] != "100" {
+		t.Errorf("Solo shares must not go into shared round, got %v", round)
+	}
+	candidates, _ := r.GetCandidates(1008)
+	if len(candidates) != 1 || !candidates[0].Solo || candidates[0].Finder != "z" {
+		t.Fatalf("Must write solo block candidate, got %v", candidates)
+	}
+	shares, _ := r.GetRoundShares(1008, "0x2")
+	if len(shares) != 1 || shares["z"] != 100 {
+		t.Errorf("Solo round must hold finder only, got %v", shares)
+	}
+}
+
+func TestReplayBlock(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	params := []string{"0x1", "0x0", "0x0"}
+	exist, err := r.ReplayBlock("y", "rig1", params, 50, 5000, 1008, time.Now().Unix(), time.Hour)
+	if err != nil || exist {
+		t.Fatalf("Must write replayed block, got %v %v", exist, err)
+	}
+	if exist, _ := r.ReplayBlock("y", "rig1", params, 50, 5000, 1008, time.Now().Unix(), time.Hour); !exist {
+		t.Errorf("Replayed block must be written once")
+	}
+
+	if r.client.Exists(r.formatKey("shares", "roundCurrent")).Val() {
+		t.Errorf("Current round must be closed by replayed block")
+	}
+	candidates, _ := r.GetCandidates(1008)
+	if len(candidates) != 1 || candidates[0].TotalShares != 150 {
+		t.Fatalf("Must write one candidate with round total, got %v", candidates)
+	}
+	shares, _ := r.GetRoundShares(1008, "0x1")
+	if shares["x"] != 100 || shares["y"] != 50 {
+		t.Errorf("Block round must hold current shares and finder, got %v", shares)
+	}
+}
+
+func TestReplayBlockBehindNewerBlock(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1010, time.Hour)
+	r.WriteBlock("x", "rig1", []string{"0x3", "0x0", "0x0"}, 100, 5000, 1010, time.Hour)
+	r.WriteShare("x", "rig1", []string{"0x4", "0x0", "0x0"}, 100, 1011, time.Hour)
+
+	exist, err := r.ReplayBlock("y", "rig1", []string{"0x1", "0x0", "0x0"}, 50, 5000, 1008, time.Now().Unix(), time.Hour)
+	if err != nil || exist {
+		t.Fatalf("Must write replayed block, got %v %v", exist, err)
+	}
+	round := r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Val()
+	if len(round) != 1 || round["x"] != "100" {
+		t.Errorf("Current round must stay open behind newer block, got %v", round)
+	}
+	shares, _ := r.GetRoundShares(1008, "0x1")
+	if len(shares) != 1 || shares["y"] != 50 {
+		t.Errorf("Block round must hold finder only, got %v", shares)
+	}
+}
+
+func TestCollectSessionCounts(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteSessionCounts("proxy1", map[string]int{"x": 2}, time.Minute)
+	r.WriteSessionCounts("proxy2", map[string]int{"x": 3}, time.Minute)
+	r.client.HSet(r.formatKey("sessions", "x"), "dead", "5:1")
+
+	stats, _ := r.CollectWorkersStats(10*time.Minute, time.Hour, "x")
+	if stats["sessions"] != int64(5) {
+		t.Errorf("Must sum live sessions of all proxies, got %v", stats["sessions"])
+	}
+	r.WriteSessionCounts("proxy2", map[string]int{"x": 0}, time.Minute)
+	stats, _ = r.CollectWorkersStats(10*time.Minute, time.Hour, "x")
+	if stats["sessions"] != int64(2) {
+		t.Errorf("Login without sessions must be removed, got %v", stats["sessions"])
+	}
+}
+
+func TestCollectShareStats(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteStaleShare("x", "rig1", []string{"0x2", "0x0", "0x0"}, 100, 1007, false, time.Hour)
+	r.WriteRejectedShare("x", "rig1", "duplicate", time.Hour)
+	r.WriteRejectedShare("x", "rig1", "invalid", time.Hour)
+	r.WriteRejectedShare("x", "rig2", "invalid", time.Hour)
+
+	stats, err := r.CollectWorkersStats(10*time.Minute, time.Hour, "x")
+	if err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	workers := stats["workers"].(map[string]Worker)
+	rig1 := workers["rig1"]
+	if rig1.ValidShares != 2 || rig1.StaleShares != 1 || rig1.DuplicateShares != 1 || rig1.RejectedShares["invalid"] != 1 {
+		t.Errorf("Wrong share counters %v", rig1)
+	}
+	rig2, ok := workers["rig2"]
+	if !ok || rig2.Offline || rig2.RejectedShares["invalid"] != 1 {
+		t.Errorf("Worker with only rejected shares must be listed, got %v", rig2)
+	}
+	if stats["workersOffline"] != int64(0) || stats["workersOnline"] != int64(1) {
+		t.Errorf("Worker with only rejected shares must not be counted, got %v online, %v offline", stats["workersOnline"], stats["workersOffline"])
+	}
+}
+
+func TestShareBatching(t *testing.T) {
+	reset()
+	r.StartShareBatching(time.Hour)
+	defer r.StopShareBatching(context.Background())
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 1008, time.Hour)
+	exist, _ := r.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 1008, time.Hour)
+	if !exist {
+		t.Error("Duplicate must be caught before flush")
+	}
+	if n := len(r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Val()); n != 0 {
+		t.Errorf("Shares must stay in memory until flush, got %v", n)
+	}
+	if err := r.FlushShares(); err != nil {
+		t.Fatalf("Failed to flush shares: %v", err)
+	}
+	if n, _ := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Int64(); n != 200 {
+		t.Errorf("Flushed round must be 200, got %v", n)
+	}
+	if n := r.client.ZCard(r.formatKey("hashrate", "x")).Val(); n != 1 {
+		t.Errorf("Worker must have single hashrate entry per flush, got %v", n)
+	}
+
+	r.WriteShare("y", "rig1", []string{"0x2", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteBlock("x", "rig1", []string{"0x3", "0x0", "0x0"}, 100, 5000, 1008, time.Hour)
+	round := r.client.HGetAllMap(r.formatRound(1008, "0x3")).Val()
+	if round["x"] != "300" || round["y"] != "100" {
+		t.Errorf("Pending shares must go into found round, got %v", round)
+	}
+	candidates, _ := r.GetCandidates(1008)
+	if len(candidates) != 1 || candidates[0].TotalShares != 400 {
+		t.Errorf("Candidate must carry round total, got %v", candidates)
+	}
+}
+
+func TestWritePendingShares(t *testing.T) {
+	reset()
+	r.StartShareBatching(time.Hour)
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	p := r.pendingShares(r.takeBatch())
+	r.StopShareBatching(context.Background())
+
+	data, _ := json.Marshal(p)
+	var replayed PendingShares
+	if err := json.Unmarshal(data, &replayed); err != nil {
+		t.Fatalf("Pending shares must survive journal, got %v", err)
+	}
+	exist, err := r.WritePendingShares(&replayed)
+	if err != nil || exist {
+		t.Fatalf("Must write pending shares, got %v %v", exist, err)
+	}
+	if exist, _ := r.WritePendingShares(&replayed); !exist {
+		t.Errorf("Pending shares must be written once")
+	}
+	if n, _ := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Int64(); n != 100 {
+		t.Errorf("Pending shares must go into round, got %v", n)
+	}
+}
+
+func TestBans(t *testing.T) {
+	reset()
+
+	now := time.Now().Unix()
+	r.WriteBan(&BanEntry{IP: "10.0.0.1", BannedAt: now, ExpiresAt: now + 60, Instance: "main", Reason: "invalid shares"}, time.Hour)
+	r.WriteBan(&BanEntry{IP: "2001:db8::1", BannedAt: now, ExpiresAt: now + 60, Instance: "eu", Reason: "socket flood"}, time.Hour)
+	r.WriteBan(&BanEntry{IP: "10.0.0.2", BannedAt: now - 60, ExpiresAt: now - 1, Instance: "main", Reason: "invalid shares"}, time.Hour)
+
+	bans, err := r.GetBans()
+	if err != nil {
+		t.Fatalf("Failed to get bans: %v", err)
+	}
+	if len(bans) != 2 {
+		t.Fatalf("Expected 2 bans in force, got %v", len(bans))
+	}
+	for _, ban := range bans {
+		if ban.IP == "2001:db8::1" && (ban.Instance != "eu" || ban.Reason != "socket flood" || ban.ExpiresAt != now+60) {
+			t.Errorf("Wrong ban %v", ban)
+		}
+	}
+	if r.client.HExists(r.formatKey("bans"), "10.0.0.2").Val() {
+		t.Error("Expired ban must be removed")
+	}
+	offences, err := r.GetOffences("10.0.0.1", now-3600)
+	if err != nil || len(offences) != 1 || offences[0].Timeout != 60 || offences[0].Reason != "invalid shares" {
+		t.Errorf("Offence must be recorded with ban, got %v %v", offences, err)
+	}
+	r.RemoveBan("10.0.0.1")
+	if bans, _ := r.GetBans(); len(bans) != 1 {
+		t.Errorf("Expected 1 ban after removal, got %v", len(bans))
+	}
+	if offences, _ := r.GetOffences("10.0.0.1", now-3600); len(offences) != 0 {
+		t.Errorf("Lift must clear offence history, got %v", offences)
+	}
+}
+
+func TestCollectReportedHashrate(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig1", []string{"0x0", "0x0", "0x0"}, 100, 1008, time.Hour)
+	r.WriteReportedHashrate("x", "rig1", 1000, time.Hour)
+	r.WriteReportedHashrate("x", "rig2", 500, time.Hour)
+
+	stats, err := r.CollectWorkersStats(10*time.Minute, time.Hour, "x")
+	if err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	workers := stats["workers"].(map[string]Worker)
+	if workers["rig1"].ReportedHR != 1000 || workers["rig1"].ReportedAt == 0 {
+		t.Errorf("Reported hashrate must be attached to worker, got %v", workers["rig1"])
+	}
+	rig2, ok := workers["rig2"]
+	if !ok || rig2.ReportedHR != 500 || rig2.HR != 0 || rig2.TotalHR != 0 || rig2.Offline {
+		t.Errorf("Worker only reporting hashrate must be listed with zero hashrate, got %v", rig2)
+	}
+	if stats["reportedHashrate"] != int64(1500) {
+		t.Errorf("Wrong total reported hashrate %v", stats["reportedHashrate"])
+	}
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {